@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/ratelimit"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Header is the request header clients may send their API key in
+	Header = "x-api-key"
+)
+
+var (
+	keysMu sync.RWMutex
+	// keys maps API keys to their settings. A nil map disables
+	// authentication.
+	keys map[string]*Key
+
+	// reservedKeys are path segments of the proxy routes, which would be
+	// routed as something other than a key
+	reservedKeys = map[string]bool{
+		"read": true,
+	}
+
+	ErrNoKey      = errors.New("missing api key")
+	ErrInvalidKey = errors.New("invalid api key")
+)
+
+// Key is an API key and what it may access. Empty Chains or Methods allow
+// all chains or methods. Methods and DenyMethods may use shell wildcards
+// such as "eth_*".
+type Key struct {
+	Key         string            `json:"key"`
+	Name        string            `json:"name"`
+	Chains      []string          `json:"chains,omitempty"`
+	Methods     []string          `json:"methods,omitempty"`
+	DenyMethods []string          `json:"denyMethods,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	// RateLimit overrides the default client rate limit for the key
+	RateLimit *ratelimit.Rate `json:"rateLimit,omitempty"`
+}
+
+// Label identifies the key in metrics and logs without exposing it.
+func (k *Key) Label() string {
+	if k.Name != "" {
+		return k.Name
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(k.Key)))[:12]
+}
+
+// ID identifies the key in rate limit buckets, so keys sharing a name are
+// limited separately.
+func (k *Key) ID() string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(k.Key)))[:32]
+}
+
+// AllowsChain reports whether the key may access the named chain.
+func (k *Key) AllowsChain(chain string) bool {
+	if len(k.Chains) == 0 {
+		return true
+	}
+	for _, c := range k.Chains {
+		if c == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy returns the key's method policy.
+func (k *Key) Policy() *MethodPolicy {
+	return &MethodPolicy{
+		Allow: k.Methods,
+		Deny:  k.DenyMethods,
+	}
+}
+
+// Enabled reports whether API keys are required.
+func Enabled() bool {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return keys != nil
+}
+
+// Authenticate returns the settings of an API key. It returns a nil key and
+// no error when authentication is disabled.
+func Authenticate(key string) (*Key, error) {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	if keys == nil {
+		return nil, nil
+	}
+	if key == "" {
+		return nil, ErrNoKey
+	}
+	k, ok := keys[key]
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	return k, nil
+}
+
+func LoadKeysFile(filename string) error {
+	l := log.WithFields(log.Fields{
+		"package":  "auth",
+		"filename": filename,
+	})
+	l.Debug("Loading api keys file")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		l.WithError(err).Error("Failed to read api keys file")
+		return err
+	}
+	var kl []*Key
+	if err := json.Unmarshal(data, &kl); err != nil {
+		l.WithError(err).Error("Failed to parse api keys file")
+		return err
+	}
+	km := make(map[string]*Key, len(kl))
+	for _, k := range kl {
+		if k.Key == "" {
+			l.WithField("name", k.Name).Error("Api key with no key")
+			return errors.New("api key with no key")
+		}
+		if reservedKeys[k.Key] {
+			l.WithField("name", k.Name).Error("Reserved api key")
+			return errors.New("api key " + k.Label() + " is a reserved path segment")
+		}
+		if _, ok := km[k.Key]; ok {
+			l.WithField("name", k.Name).Error("Duplicate api key")
+			return errors.New("duplicate api key " + k.Label())
+		}
+		km[k.Key] = k
+	}
+	keysMu.Lock()
+	keys = km
+	keysMu.Unlock()
+	l.WithField("keys", len(km)).Debug("Loaded api keys file")
+	return nil
+}
+
+// Init loads the default method policy and the API keys file at
+// API_KEYS_FILE, reloading the keys every minute until ctx is done. Without
+// API_KEYS_FILE, authentication is disabled. A failed reload keeps the
+// previously loaded keys.
+func Init(ctx context.Context) error {
+	l := log.WithFields(log.Fields{
+		"package": "auth",
+	})
+	loadDefaultPolicy()
+	filename := os.Getenv("API_KEYS_FILE")
+	if filename == "" {
+		l.Debug("No api keys file, authentication disabled")
+		return nil
+	}
+	if err := LoadKeysFile(filename); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				l.Debug("Stopped hot loading api keys file")
+				return
+			case <-time.After(time.Second * 60):
+			}
+			if err := LoadKeysFile(filename); err != nil {
+				l.WithError(err).Error("Failed to hot load api keys file")
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// useKeysFile loads a keys file with the given contents until the test ends.
+func useKeysFile(t *testing.T, contents string) error {
+	t.Helper()
+	prev := keys
+	t.Cleanup(func() { keys = prev })
+	filename := filepath.Join(t.TempDir(), "keys.json")
+	if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadKeysFile(filename)
+}
+
+func TestLoadKeysFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantKeys int
+		wantErr  bool
+	}{
+		{
+			name:     "keys",
+			contents: `[{"key":"k1","name":"indexer"},{"key":"k2"}]`,
+			wantKeys: 2,
+		},
+		{
+			name:     "no keys",
+			contents: `[]`,
+		},
+		{
+			name:     "invalid json",
+			contents: `[{"key":`,
+			wantErr:  true,
+		},
+		{
+			name:     "missing key",
+			contents: `[{"name":"indexer"}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "duplicate key",
+			contents: `[{"key":"k1","name":"a"},{"key":"k1","name":"b"}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "reserved key",
+			contents: `[{"key":"k1"},{"key":"read"}]`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys = nil
+			err := useKeysFile(t, tt.contents)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadKeysFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if keys != nil {
+					t.Error("failed load replaced the keys")
+				}
+				return
+			}
+			if len(keys) != tt.wantKeys {
+				t.Errorf("loaded %d keys, want %d", len(keys), tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	keys = nil
+	if k, err := Authenticate(""); k != nil || err != nil {
+		t.Errorf("Authenticate() with keys disabled = %v, %v, want nil, nil", k, err)
+	}
+	if err := useKeysFile(t, `[{"key":"k1","name":"indexer","chains":["ethereum"]}]`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authenticate(""); err != ErrNoKey {
+		t.Errorf("Authenticate() without a key error = %v, want %v", err, ErrNoKey)
+	}
+	if _, err := Authenticate("k2"); err != ErrInvalidKey {
+		t.Errorf("Authenticate(k2) error = %v, want %v", err, ErrInvalidKey)
+	}
+	k, err := Authenticate("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Label() != "indexer" {
+		t.Errorf("Label() = %s, want indexer", k.Label())
+	}
+	if !k.AllowsChain("ethereum") || k.AllowsChain("polygon") {
+		t.Errorf("AllowsChain() does not match chains %v", k.Chains)
+	}
+}
+
+func TestKeyLabel(t *testing.T) {
+	k := &Key{Key: "s3cret-key"}
+	if l := k.Label(); len(l) != 12 || l == k.Key {
+		t.Errorf("Label() = %s, want a 12 character hash", l)
+	}
+	if k.ID() == (&Key{Key: "other-key"}).ID() {
+		t.Error("different keys share an id")
+	}
+}
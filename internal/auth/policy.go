@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	// DefaultPolicy applies to every chain and key. Without METHOD_DENYLIST
+	// it denies methods which administer or can damage a node.
+	DefaultPolicy = &MethodPolicy{
+		Deny: []string{"admin_*", "personal_*", "miner_*", "debug_setHead"},
+	}
+)
+
+// MethodPolicy allows or denies JSON-RPC methods by name. Patterns may use
+// shell wildcards such as "debug_*". Denies take precedence, and an empty
+// allow list allows every method which is not denied.
+type MethodPolicy struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+const (
+	// NotAllowed is the rule reported for methods missing from an allow list
+	NotAllowed = "not-allowed"
+)
+
+// matchAny returns the first pattern matching the method.
+func matchAny(patterns []string, method string) (string, bool) {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, method); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// Allows reports whether the policy allows the method. A nil policy allows
+// every method.
+func (p *MethodPolicy) Allows(method string) bool {
+	_, denied := p.DeniedBy(method)
+	return !denied
+}
+
+// Empty reports whether the policy allows every method.
+func (p *MethodPolicy) Empty() bool {
+	return p == nil || len(p.Allow) == 0 && len(p.Deny) == 0
+}
+
+// DeniedBy returns the deny pattern matching the method, or NotAllowed if
+// the method is missing from the allow list. Rules come from config rather
+// than clients, so they are safe to use as metric labels.
+func (p *MethodPolicy) DeniedBy(method string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	if d, ok := matchAny(p.Deny, method); ok {
+		return d, true
+	}
+	if len(p.Allow) == 0 {
+		return "", false
+	}
+	if _, ok := matchAny(p.Allow, method); ok {
+		return "", false
+	}
+	return NotAllowed, true
+}
+
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// loadDefaultPolicy reads METHOD_ALLOWLIST and METHOD_DENYLIST. Setting
+// METHOD_DENYLIST to an empty value removes the default denies.
+func loadDefaultPolicy() {
+	if v, ok := os.LookupEnv("METHOD_DENYLIST"); ok {
+		DefaultPolicy.Deny = splitList(v)
+	}
+	DefaultPolicy.Allow = splitList(os.Getenv("METHOD_ALLOWLIST"))
+}
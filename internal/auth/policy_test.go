@@ -0,0 +1,92 @@
+package auth
+
+import "testing"
+
+func TestMethodPolicyDeniedBy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     *MethodPolicy
+		method     string
+		wantRule   string
+		wantDenied bool
+	}{
+		{
+			name:   "nil policy",
+			method: "admin_peers",
+		},
+		{
+			name:   "empty policy",
+			policy: &MethodPolicy{},
+			method: "admin_peers",
+		},
+		{
+			name:       "exact deny",
+			policy:     &MethodPolicy{Deny: []string{"debug_setHead"}},
+			method:     "debug_setHead",
+			wantRule:   "debug_setHead",
+			wantDenied: true,
+		},
+		{
+			name:       "wildcard deny",
+			policy:     &MethodPolicy{Deny: []string{"eth_call", "admin_*"}},
+			method:     "admin_peers",
+			wantRule:   "admin_*",
+			wantDenied: true,
+		},
+		{
+			name:   "not denied",
+			policy: &MethodPolicy{Deny: []string{"admin_*"}},
+			method: "eth_blockNumber",
+		},
+		{
+			name:   "allowed",
+			policy: &MethodPolicy{Allow: []string{"eth_*"}},
+			method: "eth_blockNumber",
+		},
+		{
+			name:       "missing from allow list",
+			policy:     &MethodPolicy{Allow: []string{"eth_*"}},
+			method:     "debug_traceTransaction",
+			wantRule:   NotAllowed,
+			wantDenied: true,
+		},
+		{
+			name:       "deny takes precedence",
+			policy:     &MethodPolicy{Allow: []string{"eth_*"}, Deny: []string{"eth_sendRawTransaction"}},
+			method:     "eth_sendRawTransaction",
+			wantRule:   "eth_sendRawTransaction",
+			wantDenied: true,
+		},
+		{
+			name:       "wildcards do not match across the method",
+			policy:     &MethodPolicy{Allow: []string{"eth_get*"}},
+			method:     "xeth_getBalance",
+			wantRule:   NotAllowed,
+			wantDenied: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, denied := tt.policy.DeniedBy(tt.method)
+			if rule != tt.wantRule || denied != tt.wantDenied {
+				t.Errorf("DeniedBy(%s) = %q, %v, want %q, %v", tt.method, rule, denied, tt.wantRule, tt.wantDenied)
+			}
+			if got := tt.policy.Allows(tt.method); got == tt.wantDenied {
+				t.Errorf("Allows(%s) = %v, want %v", tt.method, got, !tt.wantDenied)
+			}
+		})
+	}
+}
+
+func TestLoadDefaultPolicy(t *testing.T) {
+	defer func(p MethodPolicy) { *DefaultPolicy = p }(*DefaultPolicy)
+	t.Setenv("METHOD_DENYLIST", "")
+	t.Setenv("METHOD_ALLOWLIST", " eth_* , net_version,,")
+	loadDefaultPolicy()
+	if len(DefaultPolicy.Deny) != 0 {
+		t.Errorf("Deny = %v, want none", DefaultPolicy.Deny)
+	}
+	if want := []string{"eth_*", "net_version"}; len(DefaultPolicy.Allow) != 2 || DefaultPolicy.Allow[0] != want[0] || DefaultPolicy.Allow[1] != want[1] {
+		t.Errorf("Allow = %v, want %v", DefaultPolicy.Allow, want)
+	}
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrUnavailable = errors.New("cache unavailable")
+)
+
+// breaker stops sending commands to redis after threshold consecutive
+// failures so requests are not held up by redis timeouts. While open, the
+// cache is bypassed and redis is pinged every interval until it recovers or
+// ctx is done.
+type breaker struct {
+	ctx       context.Context
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	threshold int
+	interval  time.Duration
+	ping      func() error
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+func (b *breaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.open || b.failures < b.threshold {
+		return
+	}
+	log.WithFields(log.Fields{
+		"package":  "cache",
+		"failures": b.failures,
+	}).WithError(err).Warn("Redis unavailable, bypassing cache")
+	b.trip()
+}
+
+// trip opens the breaker and starts reconnecting. b.mu must be held.
+func (b *breaker) trip() {
+	b.open = true
+	metrics.CacheAvailable.Set(0)
+	go b.reconnect()
+}
+
+func (b *breaker) reconnect() {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	for {
+		select {
+		case <-b.ctx.Done():
+			l.Debug("Stopped reconnecting to redis")
+			return
+		case <-time.After(b.interval):
+		}
+		if err := b.ping(); err != nil {
+			l.WithError(err).Debug("Redis still unavailable")
+			continue
+		}
+		b.mu.Lock()
+		b.open = false
+		b.failures = 0
+		b.mu.Unlock()
+		metrics.CacheAvailable.Set(1)
+		l.Info("Redis available, cache restored")
+		return
+	}
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreakerReconnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		pingErr  error
+		cancel   bool
+		wantOpen bool
+	}{
+		{"recovers", nil, false, false},
+		{"stops with ctx", errors.New("down"), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			b := &breaker{
+				ctx:       ctx,
+				threshold: 2,
+				interval:  time.Millisecond,
+				ping:      func() error { return tt.pingErr },
+				open:      true,
+			}
+			done := make(chan struct{})
+			go func() {
+				b.reconnect()
+				close(done)
+			}()
+			if tt.cancel {
+				time.Sleep(5 * time.Millisecond)
+				cancel()
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("reconnect did not return")
+			}
+			if b.allow() == tt.wantOpen {
+				t.Errorf("allow() = %v, want %v", b.allow(), !tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestBreakerTrips(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := &breaker{
+		ctx:       ctx,
+		threshold: 2,
+		interval:  time.Hour,
+		ping:      func() error { return nil },
+	}
+	b.failure(errors.New("timeout"))
+	if !b.allow() {
+		t.Fatal("tripped before the threshold")
+	}
+	b.success()
+	b.failure(errors.New("timeout"))
+	if !b.allow() {
+		t.Fatal("success did not reset the failures")
+	}
+	b.failure(errors.New("timeout"))
+	if b.allow() {
+		t.Fatal("did not trip at the threshold")
+	}
+}
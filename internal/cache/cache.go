@@ -1,69 +1,462 @@
 package cache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/robertlestak/ethlb/internal/health"
+	"github.com/robertlestak/ethlb/internal/metrics"
 
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	Client *redis.Client
+	Client        redis.UniversalClient
+	backend       Cache
+	redisBreaker  *breaker
+	cacheRequired bool
+	// subs are the open subscriptions, closed with the client
+	subsMu sync.Mutex
+	subs   []*redis.PubSub
+
+	ErrNoRedis = errors.New("redis is not configured")
 )
 
 const (
-	cachePrefix = "cache:"
+	cachePrefix      = "cache:"
+	cacheIndexPrefix = "cacheidx:"
 )
 
-func Init() error {
+// Cache is a key/value store for proxied responses. Keys passed to a Cache
+// are already namespaced by the package level helpers.
+type Cache interface {
+	Get(key string) (string, error)
+	Set(key string, value string, exp time.Duration) error
+	Del(keys ...string) error
+	// AddToIndex adds key to the named index set, which expires after exp.
+	AddToIndex(index string, key string, exp time.Duration) error
+	IndexMembers(index string) ([]string, error)
+	// Scan calls fn with batches of keys starting with prefix.
+	Scan(prefix string, fn func(keys []string) error) error
+}
+
+func initRedis(ctx context.Context) error {
 	l := log.WithFields(log.Fields{
 		"package": "cache",
 	})
 	l.Debug("Initializing redis client")
-	Client = redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")),
-		Password: "", // no password set
-		DB:       0,  // use default DB
+	cfg, err := loadRedisConfig()
+	if err != nil {
+		l.WithError(err).Error("Failed to load redis config")
+		return err
+	}
+	l = l.WithFields(log.Fields{
+		"mode":  cfg.Mode,
+		"addrs": cfg.Addrs,
+		"tls":   cfg.TLS,
 	})
+	Client, err = newRedisClient(cfg)
+	if err != nil {
+		l.WithError(err).Error("Failed to create redis client")
+		return err
+	}
+	redisBreaker = &breaker{
+		ctx:       ctx,
+		threshold: 3,
+		interval:  time.Second * 5,
+		ping: func() error {
+			return Client.Ping().Err()
+		},
+	}
+	if os.Getenv("CACHE_BREAKER_THRESHOLD") != "" {
+		redisBreaker.threshold, err = strconv.Atoi(os.Getenv("CACHE_BREAKER_THRESHOLD"))
+		if err != nil {
+			l.WithError(err).Error("Failed to parse CACHE_BREAKER_THRESHOLD")
+			return err
+		}
+	}
+	if os.Getenv("CACHE_RECONNECT_INTERVAL") != "" {
+		redisBreaker.interval, err = time.ParseDuration(os.Getenv("CACHE_RECONNECT_INTERVAL"))
+		if err != nil {
+			l.WithError(err).Error("Failed to parse CACHE_RECONNECT_INTERVAL")
+			return err
+		}
+	}
+	metrics.CacheAvailable.Set(1)
 	cmd := Client.Ping()
 	if cmd.Err() != nil {
-		l.Error("Failed to connect to redis")
-		return cmd.Err()
+		if cacheRequired {
+			l.Error("Failed to connect to redis")
+			return cmd.Err()
+		}
+		// start with the cache bypassed and keep trying in the background
+		l.WithError(cmd.Err()).Warn("Failed to connect to redis, starting with cache bypassed")
+		redisBreaker.mu.Lock()
+		redisBreaker.trip()
+		redisBreaker.mu.Unlock()
+		return nil
 	}
 	l.Debug("Connected to redis")
 	return nil
 }
 
+func redisReady() error {
+	if Client == nil {
+		return ErrNoRedis
+	}
+	if !redisBreaker.allow() {
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// Available reports whether the cache backend is currently serving requests.
+func Available() bool {
+	if redisBreaker == nil {
+		return backend != nil
+	}
+	return redisBreaker.allow()
+}
+
+func newLRUFromEnv() (*lruCache, error) {
+	size := 10000
+	var maxBytes int64
+	var err error
+	if os.Getenv("CACHE_LRU_SIZE") != "" {
+		size, err = strconv.Atoi(os.Getenv("CACHE_LRU_SIZE"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if os.Getenv("CACHE_LRU_MAX_BYTES") != "" {
+		maxBytes, err = strconv.ParseInt(os.Getenv("CACHE_LRU_MAX_BYTES"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newLRUCache(size, maxBytes), nil
+}
+
+// Init configures the cache backend selected by CACHE_BACKEND: "redis"
+// (default), "memory" for an in-process LRU, or "tiered" for a local LRU in
+// front of redis. Reconnecting to an unavailable redis stops once ctx is
+// done.
+func Init(ctx context.Context) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+		"backend": os.Getenv("CACHE_BACKEND"),
+	})
+	l.Debug("Initializing cache")
+	cacheRequired = os.Getenv("CACHE_REQUIRED") == "true"
+	check := func() error {
+		if !Available() {
+			return ErrUnavailable
+		}
+		return nil
+	}
+	health.Register("cache", check)
+	if cacheRequired {
+		// without the cache requests fail, so the replica is not ready
+		health.RegisterReadiness("cache", check)
+	}
+	switch os.Getenv("CACHE_BACKEND") {
+	case "", "redis":
+		if err := initRedis(ctx); err != nil {
+			return err
+		}
+		backend = &redisCache{client: Client, breaker: redisBreaker}
+	case "memory":
+		lc, err := newLRUFromEnv()
+		if err != nil {
+			l.WithError(err).Error("Failed to configure lru cache")
+			return err
+		}
+		backend = lc
+	case "tiered":
+		lc, err := newLRUFromEnv()
+		if err != nil {
+			l.WithError(err).Error("Failed to configure lru cache")
+			return err
+		}
+		localTTL := time.Second * 30
+		if os.Getenv("CACHE_LOCAL_TTL") != "" {
+			localTTL, err = time.ParseDuration(os.Getenv("CACHE_LOCAL_TTL"))
+			if err != nil {
+				l.WithError(err).Error("Failed to parse CACHE_LOCAL_TTL")
+				return err
+			}
+		}
+		if err := initRedis(ctx); err != nil {
+			return err
+		}
+		tc := &tieredCache{
+			local:    lc,
+			remote:   &redisCache{client: Client, breaker: redisBreaker},
+			localTTL: localTTL,
+		}
+		if err := tc.listen(); err != nil {
+			l.WithError(err).Error("Failed to subscribe to cache invalidations")
+			return err
+		}
+		backend = tc
+	default:
+		return fmt.Errorf("unknown cache backend %q", os.Getenv("CACHE_BACKEND"))
+	}
+	l.Debug("Initialized cache")
+	return nil
+}
+
 func Get(key string) (string, error) {
 	l := log.WithFields(log.Fields{
 		"package": "cache",
 	})
-	l.Debug("Getting key from redis")
-	cmd := Client.Get(cachePrefix + key)
-	if cmd.Err() != nil && cmd.Err() != redis.Nil {
-		l.Error("Failed to get key from redis")
-		return "", cmd.Err()
-	} else if cmd.Err() == redis.Nil {
-		l.Debug("Key not found in redis")
-		return "", nil
+	l.Debug("Getting key from cache")
+	v, err := backend.Get(cachePrefix + key)
+	if err != nil {
+		l.Error("Failed to get key from cache")
+		return "", err
 	}
-	l.Debug("Got key from redis")
-	return cmd.Result()
+	return v, nil
 }
 
 func Set(key string, value string, exp time.Duration) error {
 	l := log.WithFields(log.Fields{
 		"package": "cache",
 	})
-	l.Debug("Setting key in redis")
-	cmd := Client.Set(cachePrefix+key, value, exp)
+	l.Debug("Setting key in cache")
+	if err := backend.Set(cachePrefix+key, value, exp); err != nil {
+		l.Error("Failed to set key in cache")
+		return err
+	}
+	return nil
+}
+
+func Del(keys ...string) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	l.Debug("Deleting keys from cache")
+	pk := make([]string, len(keys))
+	for i, k := range keys {
+		pk[i] = cachePrefix + k
+	}
+	if err := backend.Del(pk...); err != nil {
+		l.Error("Failed to delete keys from cache")
+		return err
+	}
+	return nil
+}
+
+// Scan calls fn with batches of cache keys starting with prefix.
+func Scan(prefix string, fn func(keys []string) error) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+		"prefix":  prefix,
+	})
+	l.Debug("Scanning cache keys")
+	err := backend.Scan(cachePrefix+prefix, func(keys []string) error {
+		for i, k := range keys {
+			keys[i] = strings.TrimPrefix(k, cachePrefix)
+		}
+		return fn(keys)
+	})
+	if err != nil {
+		l.Error("Failed to scan cache keys")
+		return err
+	}
+	return nil
+}
+
+// DelPrefix deletes all cache keys starting with prefix and returns the
+// number of keys removed.
+func DelPrefix(prefix string) (int, error) {
+	var n int
+	err := Scan(prefix, func(keys []string) error {
+		if err := Del(keys...); err != nil {
+			return err
+		}
+		n += len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// AddToIndex records key under index so related entries can be found and
+// invalidated together, e.g. all entries tied to a block height.
+func AddToIndex(index string, key string, exp time.Duration) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+		"index":   index,
+	})
+	l.Debug("Adding key to cache index")
+	if err := backend.AddToIndex(cacheIndexPrefix+index, key, exp); err != nil {
+		l.Error("Failed to add key to cache index")
+		return err
+	}
+	return nil
+}
+
+func IndexMembers(index string) ([]string, error) {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+		"index":   index,
+	})
+	l.Debug("Getting cache index members")
+	m, err := backend.IndexMembers(cacheIndexPrefix + index)
+	if err != nil {
+		l.Error("Failed to get cache index members")
+		return nil, err
+	}
+	return m, nil
+}
+
+func DelIndex(indexes ...string) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	l.Debug("Deleting cache indexes")
+	pk := make([]string, len(indexes))
+	for i, k := range indexes {
+		pk[i] = cacheIndexPrefix + k
+	}
+	if err := backend.Del(pk...); err != nil {
+		l.Error("Failed to delete cache indexes")
+		return err
+	}
+	return nil
+}
+
+func Publish(channel string, message string) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+		"channel": channel,
+	})
+	l.Debug("Publishing message to redis")
+	if err := redisReady(); err != nil {
+		return err
+	}
+	cmd := Client.Publish(channel, message)
+	if cmd.Err() != nil {
+		l.Error("Failed to publish message to redis")
+		return cmd.Err()
+	}
+	l.Debug("Published message to redis")
+	return nil
+}
+
+// Subscribe returns a subscription to channel. The caller must close the
+// returned PubSub when it is no longer needed.
+func Subscribe(channel string) (*redis.PubSub, error) {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+		"channel": channel,
+	})
+	l.Debug("Subscribing to redis channel")
+	if Client == nil {
+		return nil, ErrNoRedis
+	}
+	ps := Client.Subscribe(channel)
+	subsMu.Lock()
+	subs = append(subs, ps)
+	subsMu.Unlock()
+	return ps, nil
+}
+
+// Close closes the redis subscriptions and client.
+func Close() error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	if Client == nil {
+		return nil
+	}
+	l.Debug("Closing redis client")
+	subsMu.Lock()
+	for _, ps := range subs {
+		if err := ps.Close(); err != nil {
+			l.WithError(err).Warn("Failed to close redis subscription")
+		}
+	}
+	subs = nil
+	subsMu.Unlock()
+	if err := Client.Close(); err != nil {
+		l.WithError(err).Error("Failed to close redis client")
+		return err
+	}
+	return nil
+}
+
+func SetHashField(key string, field string, value string) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	l.Debug("Setting hash field in redis")
+	if err := redisReady(); err != nil {
+		return err
+	}
+	cmd := Client.HSet(key, field, value)
+	if cmd.Err() != nil {
+		l.Error("Failed to set hash field in redis")
+		return cmd.Err()
+	}
+	return nil
+}
+
+func DelHashFields(key string, fields ...string) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	l.Debug("Deleting hash fields in redis")
+	if err := redisReady(); err != nil {
+		return err
+	}
+	cmd := Client.HDel(key, fields...)
 	if cmd.Err() != nil {
-		l.Error("Failed to set key in redis")
+		l.Error("Failed to delete hash fields in redis")
 		return cmd.Err()
 	}
-	l.Debug("Set key in redis")
 	return nil
 }
+
+func GetHash(key string) (map[string]string, error) {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	l.Debug("Getting hash from redis")
+	if err := redisReady(); err != nil {
+		return nil, err
+	}
+	cmd := Client.HGetAll(key)
+	if cmd.Err() != nil && cmd.Err() != redis.Nil {
+		l.Error("Failed to get hash from redis")
+		return nil, cmd.Err()
+	}
+	return cmd.Val(), nil
+}
+
+// RunScript runs a Lua script on redis, for callers such as the rate
+// limiter which keep shared state beside the cache.
+func RunScript(s *redis.Script, keys []string, args ...interface{}) (interface{}, error) {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	l.Debug("Running script in redis")
+	if err := redisReady(); err != nil {
+		return nil, err
+	}
+	v, err := s.Run(Client, keys, args...).Result()
+	if err != nil && err != redis.Nil {
+		l.Error("Failed to run script in redis")
+		redisBreaker.failure(err)
+		return nil, err
+	}
+	redisBreaker.success()
+	return v, nil
+}
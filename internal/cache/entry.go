@@ -0,0 +1,209 @@
+package cache
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	entryVersion1 = 1
+	// entryVersion2 adds soft and hard expirations
+	entryVersion2 = 2
+)
+
+var (
+	// entryMagic prefixes every binary entry. Legacy entries are base64 text
+	// and can never start with these bytes.
+	entryMagic = []byte{0xe7, 0x1b}
+
+	ErrLegacyEntry             = errors.New("legacy cache entry")
+	ErrUnsupportedEntryVersion = errors.New("unsupported cache entry version")
+	ErrCorruptEntry            = errors.New("corrupt cache entry")
+)
+
+// Entry is a cached upstream response along with where and when it was
+// fetched. The body is the uncompressed JSON-RPC payload.
+type Entry struct {
+	StatusCode  int
+	Header      http.Header
+	Body        []byte
+	Endpoint    string
+	BlockHeight uint64
+	CreatedAt   time.Time
+	// SoftExpiry is when the entry becomes stale. Stale entries may still be
+	// served until HardExpiry while they are refreshed or when upstreams
+	// fail. Zero values mean the entry never goes stale, as for v1 entries.
+	SoftExpiry time.Time
+	HardExpiry time.Time
+}
+
+// Stale reports whether the entry is past its soft expiry at t.
+func (e *Entry) Stale(t time.Time) bool {
+	return !e.SoftExpiry.IsZero() && t.After(e.SoftExpiry)
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Encode serializes the entry in the current binary format:
+//
+//	magic[2] version[1] status createdAt blockHeight softExpiry hardExpiry
+//	endpoint headerCount (name value)* deflate(body)
+//
+// Integers are varints and strings are length-prefixed. Version 1 entries,
+// which lack the expirations, are still decoded.
+func (e *Entry) Encode() (string, error) {
+	var buf bytes.Buffer
+	buf.Write(entryMagic)
+	buf.WriteByte(entryVersion2)
+	putUvarint(&buf, uint64(e.StatusCode))
+	putVarint(&buf, e.CreatedAt.UnixNano())
+	putUvarint(&buf, e.BlockHeight)
+	putVarint(&buf, unixNano(e.SoftExpiry))
+	putVarint(&buf, unixNano(e.HardExpiry))
+	putBytes(&buf, []byte(e.Endpoint))
+	var hc uint64
+	for _, vs := range e.Header {
+		hc += uint64(len(vs))
+	}
+	putUvarint(&buf, hc)
+	for n, vs := range e.Header {
+		for _, v := range vs {
+			putBytes(&buf, []byte(n))
+			putBytes(&buf, []byte(v))
+		}
+	}
+	var body bytes.Buffer
+	fw, err := flate.NewWriter(&body, flate.BestSpeed)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write(e.Body); err != nil {
+		return "", err
+	}
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+	putBytes(&buf, body.Bytes())
+	return buf.String(), nil
+}
+
+// DecodeEntry parses an entry written by Encode. It returns ErrLegacyEntry for
+// entries stored before the binary format existed and
+// ErrUnsupportedEntryVersion for entries written by a newer ethlb, so callers
+// can fall back or treat them as a miss.
+func DecodeEntry(s string) (*Entry, error) {
+	b := []byte(s)
+	if !bytes.HasPrefix(b, entryMagic) {
+		return nil, ErrLegacyEntry
+	}
+	r := bytes.NewReader(b[len(entryMagic):])
+	v, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrCorruptEntry
+	}
+	if v != entryVersion1 && v != entryVersion2 {
+		return nil, ErrUnsupportedEntryVersion
+	}
+	e := &Entry{
+		Header: make(http.Header),
+	}
+	status, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorruptEntry
+	}
+	e.StatusCode = int(status)
+	created, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, ErrCorruptEntry
+	}
+	e.CreatedAt = time.Unix(0, created)
+	if e.BlockHeight, err = binary.ReadUvarint(r); err != nil {
+		return nil, ErrCorruptEntry
+	}
+	if v >= entryVersion2 {
+		soft, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, ErrCorruptEntry
+		}
+		hard, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, ErrCorruptEntry
+		}
+		e.SoftExpiry = fromUnixNano(soft)
+		e.HardExpiry = fromUnixNano(hard)
+	}
+	endpoint, err := readBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	e.Endpoint = string(endpoint)
+	hc, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorruptEntry
+	}
+	for i := uint64(0); i < hc; i++ {
+		n, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		e.Header.Add(string(n), string(v))
+	}
+	body, err := readBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	fr := flate.NewReader(bytes.NewReader(body))
+	defer fr.Close()
+	if e.Body, err = ioutil.ReadAll(fr); err != nil {
+		return nil, ErrCorruptEntry
+	}
+	return e, nil
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func putVarint(buf *bytes.Buffer, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func putBytes(buf *bytes.Buffer, p []byte) {
+	putUvarint(buf, uint64(len(p)))
+	buf.Write(p)
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, ErrCorruptEntry
+	}
+	p := make([]byte, n)
+	if _, err := r.Read(p); err != nil && n > 0 {
+		return nil, ErrCorruptEntry
+	}
+	return p, nil
+}
@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"bytes"
+	"compress/flate"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// encodeV1 writes an entry in the version 1 format, which has no
+// expirations.
+func encodeV1(t *testing.T, e *Entry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.Write(entryMagic)
+	buf.WriteByte(entryVersion1)
+	putUvarint(&buf, uint64(e.StatusCode))
+	putVarint(&buf, e.CreatedAt.UnixNano())
+	putUvarint(&buf, e.BlockHeight)
+	putBytes(&buf, []byte(e.Endpoint))
+	putUvarint(&buf, 0)
+	var body bytes.Buffer
+	fw, err := flate.NewWriter(&body, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(e.Body); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	putBytes(&buf, body.Bytes())
+	return buf.String()
+}
+
+func TestEntryEncodeDecode(t *testing.T) {
+	created := time.Unix(1700000000, 123)
+	e := &Entry{
+		StatusCode:  http.StatusOK,
+		Header:      http.Header{"Content-Type": {"application/json"}, "Vary": {"a", "b"}},
+		Body:        []byte(`{"jsonrpc":"2.0","id":1,"result":"0x64"}`),
+		Endpoint:    "http://127.0.0.1:8545",
+		BlockHeight: 100,
+		CreatedAt:   created,
+		SoftExpiry:  created.Add(time.Minute),
+		HardExpiry:  created.Add(time.Hour),
+	}
+	v2, err := e.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := encodeV1(t, e)
+	tests := []struct {
+		name    string
+		data    string
+		want    *Entry
+		wantErr error
+	}{
+		{
+			name: "v2",
+			data: v2,
+			want: e,
+		},
+		{
+			name: "v2 without expiry",
+			data: func() string {
+				ne := *e
+				ne.SoftExpiry, ne.HardExpiry = time.Time{}, time.Time{}
+				s, err := ne.Encode()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}(),
+			want: &Entry{
+				StatusCode:  e.StatusCode,
+				Header:      e.Header,
+				Body:        e.Body,
+				Endpoint:    e.Endpoint,
+				BlockHeight: e.BlockHeight,
+				CreatedAt:   e.CreatedAt,
+			},
+		},
+		{
+			name: "v1",
+			data: v1,
+			want: &Entry{
+				StatusCode:  e.StatusCode,
+				Header:      http.Header{},
+				Body:        e.Body,
+				Endpoint:    e.Endpoint,
+				BlockHeight: e.BlockHeight,
+				CreatedAt:   e.CreatedAt,
+			},
+		},
+		{
+			name:    "legacy",
+			data:    "eyJqc29ucnBjIjoiMi4wIn0=",
+			wantErr: ErrLegacyEntry,
+		},
+		{
+			name:    "empty",
+			data:    "",
+			wantErr: ErrLegacyEntry,
+		},
+		{
+			name:    "newer version",
+			data:    string(append(append([]byte{}, entryMagic...), entryVersion2+1)),
+			wantErr: ErrUnsupportedEntryVersion,
+		},
+		{
+			name:    "magic only",
+			data:    string(entryMagic),
+			wantErr: ErrCorruptEntry,
+		},
+		{
+			name:    "truncated header",
+			data:    v2[:len(entryMagic)+4],
+			wantErr: ErrCorruptEntry,
+		},
+		{
+			name:    "truncated body",
+			data:    v2[:len(v2)-3],
+			wantErr: ErrCorruptEntry,
+		},
+		{
+			name:    "truncated v1",
+			data:    v1[:len(v1)-3],
+			wantErr: ErrCorruptEntry,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeEntry(tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("DecodeEntry() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if !got.CreatedAt.Equal(tt.want.CreatedAt) ||
+				!got.SoftExpiry.Equal(tt.want.SoftExpiry) ||
+				!got.HardExpiry.Equal(tt.want.HardExpiry) {
+				t.Errorf("DecodeEntry() times = %v %v %v, want %v %v %v",
+					got.CreatedAt, got.SoftExpiry, got.HardExpiry,
+					tt.want.CreatedAt, tt.want.SoftExpiry, tt.want.HardExpiry)
+			}
+			if got.StatusCode != tt.want.StatusCode || got.Endpoint != tt.want.Endpoint ||
+				got.BlockHeight != tt.want.BlockHeight || !bytes.Equal(got.Body, tt.want.Body) {
+				t.Errorf("DecodeEntry() = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(got.Header, tt.want.Header) {
+				t.Errorf("DecodeEntry() header = %v, want %v", got.Header, tt.want.Header)
+			}
+		})
+	}
+}
+
+func TestEntryStale(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		soft time.Time
+		want bool
+	}{
+		{"no expiry", time.Time{}, false},
+		{"fresh", now.Add(time.Second), false},
+		{"stale", now.Add(-time.Second), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Entry{SoftExpiry: tt.soft}
+			if got := e.Stale(now); got != tt.want {
+				t.Errorf("Stale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
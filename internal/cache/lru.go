@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+type lruEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+type lruIndex struct {
+	members map[string]struct{}
+	expires time.Time
+}
+
+// lruCache is an in-process cache bounded by entry count and, optionally,
+// by the total size of keys and values in bytes. Index sets are kept apart
+// from the entries and swept once they expire.
+type lruCache struct {
+	mu        sync.Mutex
+	maxItems  int
+	maxBytes  int64
+	bytes     int64
+	ll        *list.List
+	items     map[string]*list.Element
+	indexes   map[string]*lruIndex
+	lastSweep time.Time
+}
+
+func newLRUCache(maxItems int, maxBytes int64) *lruCache {
+	return &lruCache{
+		maxItems: maxItems,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		indexes:  make(map[string]*lruIndex),
+	}
+}
+
+func (c *lruCache) Get(key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return "", nil
+	}
+	e := el.Value.(*lruEntry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		c.removeElement(el)
+		return "", nil
+	}
+	c.ll.MoveToFront(el)
+	return e.value, nil
+}
+
+func (c *lruCache) Set(key string, value string, exp time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var expires time.Time
+	if exp > 0 {
+		expires = time.Now().Add(exp)
+	}
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		c.bytes += int64(len(value) - len(e.value))
+		e.value = value
+		e.expires = expires
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, expires: expires})
+		c.bytes += int64(len(key) + len(value))
+	}
+	for c.ll.Len() > 0 && ((c.maxItems > 0 && c.ll.Len() > c.maxItems) || (c.maxBytes > 0 && c.bytes > c.maxBytes)) {
+		c.removeElement(c.ll.Back())
+	}
+	return nil
+}
+
+func (c *lruCache) Del(keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		if el, ok := c.items[k]; ok {
+			c.removeElement(el)
+		}
+		delete(c.indexes, k)
+	}
+	return nil
+}
+
+func (c *lruCache) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*lruEntry)
+	delete(c.items, e.key)
+	c.bytes -= int64(len(e.key) + len(e.value))
+}
+
+func (c *lruCache) AddToIndex(index string, key string, exp time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) > time.Minute {
+		for n, idx := range c.indexes {
+			if now.After(idx.expires) {
+				delete(c.indexes, n)
+			}
+		}
+		c.lastSweep = now
+	}
+	idx, ok := c.indexes[index]
+	if !ok || now.After(idx.expires) {
+		idx = &lruIndex{members: make(map[string]struct{})}
+		c.indexes[index] = idx
+	}
+	idx.members[key] = struct{}{}
+	idx.expires = now.Add(exp)
+	return nil
+}
+
+func (c *lruCache) IndexMembers(index string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idx, ok := c.indexes[index]
+	if !ok || time.Now().After(idx.expires) {
+		return nil, nil
+	}
+	m := make([]string, 0, len(idx.members))
+	for k := range idx.members {
+		m = append(m, k)
+	}
+	return m, nil
+}
+
+func (c *lruCache) Scan(prefix string, fn func(keys []string) error) error {
+	c.mu.Lock()
+	var keys []string
+	for k := range c.items {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	c.mu.Unlock()
+	for len(keys) > 0 {
+		n := 1000
+		if n > len(keys) {
+			n = len(keys)
+		}
+		if err := fn(keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
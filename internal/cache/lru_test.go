@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	type op struct {
+		get   bool
+		key   string
+		value string
+	}
+	tests := []struct {
+		name     string
+		maxItems int
+		maxBytes int64
+		ops      []op
+		present  []string
+		evicted  []string
+	}{
+		{
+			name:     "evicts least recently set",
+			maxItems: 2,
+			ops:      []op{{key: "a", value: "1"}, {key: "b", value: "2"}, {key: "c", value: "3"}},
+			present:  []string{"b", "c"},
+			evicted:  []string{"a"},
+		},
+		{
+			name:     "get refreshes recency",
+			maxItems: 2,
+			ops:      []op{{key: "a", value: "1"}, {key: "b", value: "2"}, {get: true, key: "a"}, {key: "c", value: "3"}},
+			present:  []string{"a", "c"},
+			evicted:  []string{"b"},
+		},
+		{
+			name:     "overwrite does not grow",
+			maxItems: 2,
+			ops:      []op{{key: "a", value: "1"}, {key: "b", value: "2"}, {key: "a", value: "3"}},
+			present:  []string{"a", "b"},
+		},
+		{
+			name:     "evicts by bytes",
+			maxBytes: 8,
+			ops:      []op{{key: "a", value: "111"}, {key: "b", value: "222"}, {key: "c", value: "333"}},
+			present:  []string{"b", "c"},
+			evicted:  []string{"a"},
+		},
+		{
+			name:     "growing value evicts by bytes",
+			maxBytes: 8,
+			ops:      []op{{key: "a", value: "1"}, {key: "b", value: "2"}, {key: "b", value: "222222"}},
+			present:  []string{"b"},
+			evicted:  []string{"a"},
+		},
+		{
+			name:     "value larger than the cache",
+			maxBytes: 4,
+			ops:      []op{{key: "a", value: "1"}, {key: "b", value: "22222"}},
+			evicted:  []string{"a", "b"},
+		},
+		{
+			name:    "unbounded",
+			ops:     []op{{key: "a", value: "1"}, {key: "b", value: "2"}, {key: "c", value: "3"}},
+			present: []string{"a", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newLRUCache(tt.maxItems, tt.maxBytes)
+			for _, o := range tt.ops {
+				if o.get {
+					if _, err := c.Get(o.key); err != nil {
+						t.Fatal(err)
+					}
+				} else if err := c.Set(o.key, o.value, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, k := range tt.present {
+				if v, _ := c.Get(k); v == "" {
+					t.Errorf("%s was evicted", k)
+				}
+			}
+			for _, k := range tt.evicted {
+				if v, _ := c.Get(k); v != "" {
+					t.Errorf("%s = %q, want evicted", k, v)
+				}
+			}
+			var size int64
+			for k, el := range c.items {
+				size += int64(len(k) + len(el.Value.(*lruEntry).value))
+			}
+			if c.bytes != size {
+				t.Errorf("bytes = %d, want %d", c.bytes, size)
+			}
+		})
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	c := newLRUCache(0, 0)
+	if err := c.Set("a", "1", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("b", "2", 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if v, _ := c.Get("a"); v != "" {
+		t.Errorf("a = %q, want expired", v)
+	}
+	if v, _ := c.Get("b"); v != "2" {
+		t.Errorf("b = %q, want 2", v)
+	}
+	if c.bytes != 2 {
+		t.Errorf("bytes = %d, want 2", c.bytes)
+	}
+}
@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+type redisCache struct {
+	client  redis.UniversalClient
+	breaker *breaker
+}
+
+func (c *redisCache) Get(key string) (string, error) {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	if !c.breaker.allow() {
+		l.Debug("Redis unavailable, bypassing cache")
+		return "", nil
+	}
+	l.Debug("Getting key from redis")
+	cmd := c.client.Get(key)
+	if cmd.Err() != nil && cmd.Err() != redis.Nil {
+		l.Error("Failed to get key from redis")
+		c.breaker.failure(cmd.Err())
+		return "", cmd.Err()
+	}
+	c.breaker.success()
+	if cmd.Err() == redis.Nil {
+		l.Debug("Key not found in redis")
+		return "", nil
+	}
+	l.Debug("Got key from redis")
+	return cmd.Result()
+}
+
+// GetTTL returns the value of key and the time until it expires, or a
+// negative duration if it does not expire.
+func (c *redisCache) GetTTL(key string) (string, time.Duration, error) {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	if !c.breaker.allow() {
+		l.Debug("Redis unavailable, bypassing cache")
+		return "", 0, nil
+	}
+	l.Debug("Getting key and ttl from redis")
+	pipe := c.client.Pipeline()
+	get := pipe.Get(key)
+	ttl := pipe.PTTL(key)
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		l.Error("Failed to get key from redis")
+		c.breaker.failure(err)
+		return "", 0, err
+	}
+	c.breaker.success()
+	// PTTL is -2ms for missing keys and -1ms for keys without expiry
+	if get.Err() == redis.Nil || ttl.Val() == -2*time.Millisecond {
+		l.Debug("Key not found in redis")
+		return "", 0, nil
+	}
+	if ttl.Val() < 0 {
+		return get.Val(), -1, nil
+	}
+	return get.Val(), ttl.Val(), nil
+}
+
+func (c *redisCache) Set(key string, value string, exp time.Duration) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	if !c.breaker.allow() {
+		l.Debug("Redis unavailable, bypassing cache")
+		return nil
+	}
+	l.Debug("Setting key in redis")
+	cmd := c.client.Set(key, value, exp)
+	if cmd.Err() != nil {
+		l.Error("Failed to set key in redis")
+		c.breaker.failure(cmd.Err())
+		return cmd.Err()
+	}
+	c.breaker.success()
+	l.Debug("Set key in redis")
+	return nil
+}
+
+func (c *redisCache) Del(keys ...string) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	l.Debug("Deleting keys from redis")
+	if len(keys) == 0 {
+		return nil
+	}
+	if !c.breaker.allow() {
+		return ErrUnavailable
+	}
+	cmd := c.client.Del(keys...)
+	if cmd.Err() != nil {
+		l.Error("Failed to delete keys from redis")
+		c.breaker.failure(cmd.Err())
+		return cmd.Err()
+	}
+	c.breaker.success()
+	return nil
+}
+
+func (c *redisCache) AddToIndex(index string, key string, exp time.Duration) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	if !c.breaker.allow() {
+		return nil
+	}
+	_, err := c.client.Pipelined(func(p redis.Pipeliner) error {
+		p.SAdd(index, key)
+		p.Expire(index, exp)
+		return nil
+	})
+	if err != nil {
+		l.Error("Failed to add key to index in redis")
+		c.breaker.failure(err)
+		return err
+	}
+	c.breaker.success()
+	return nil
+}
+
+func (c *redisCache) IndexMembers(index string) ([]string, error) {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	if !c.breaker.allow() {
+		return nil, ErrUnavailable
+	}
+	cmd := c.client.SMembers(index)
+	if cmd.Err() != nil && cmd.Err() != redis.Nil {
+		l.Error("Failed to get index members from redis")
+		c.breaker.failure(cmd.Err())
+		return nil, cmd.Err()
+	}
+	c.breaker.success()
+	return cmd.Val(), nil
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (c *redisCache) Scan(prefix string, fn func(keys []string) error) error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	if !c.breaker.allow() {
+		return ErrUnavailable
+	}
+	match := globEscaper.Replace(prefix) + "*"
+	scan := func(client redis.Cmdable) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(cursor, match, 1000).Result()
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				if err := fn(keys); err != nil {
+					return err
+				}
+			}
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	}
+	var err error
+	// keys are spread over all masters of a cluster
+	if cc, ok := c.client.(*redis.ClusterClient); ok {
+		err = cc.ForEachMaster(func(client *redis.Client) error {
+			return scan(client)
+		})
+	} else {
+		err = scan(c.client)
+	}
+	if err != nil {
+		l.Error("Failed to scan keys in redis")
+		return err
+	}
+	return nil
+}
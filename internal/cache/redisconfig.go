@@ -0,0 +1,232 @@
+package cache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	redisModeSingle   = "single"
+	redisModeSentinel = "sentinel"
+	redisModeCluster  = "cluster"
+)
+
+// redisConfig describes how to connect to redis. It is read from the JSON
+// file at REDIS_CONFIG_FILE, if set, and then overridden by REDIS_* env vars.
+type redisConfig struct {
+	Mode       string   `json:"mode"`
+	Addrs      []string `json:"addrs"`
+	MasterName string   `json:"masterName"`
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	DB         int      `json:"db"`
+
+	TLS                   bool   `json:"tls"`
+	TLSCAFile             string `json:"tlsCaFile"`
+	TLSCertFile           string `json:"tlsCertFile"`
+	TLSKeyFile            string `json:"tlsKeyFile"`
+	TLSServerName         string `json:"tlsServerName"`
+	TLSInsecureSkipVerify bool   `json:"tlsInsecureSkipVerify"`
+
+	DialTimeout  time.Duration `json:"-"`
+	ReadTimeout  time.Duration `json:"-"`
+	WriteTimeout time.Duration `json:"-"`
+}
+
+func loadRedisConfig() (*redisConfig, error) {
+	// short timeouts keep a hung redis from stalling requests before the
+	// cache breaker trips
+	cfg := &redisConfig{
+		DialTimeout:  time.Second * 2,
+		ReadTimeout:  time.Millisecond * 500,
+		WriteTimeout: time.Millisecond * 500,
+	}
+	if f := os.Getenv("REDIS_CONFIG_FILE"); f != "" {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if os.Getenv("REDIS_MODE") != "" {
+		cfg.Mode = os.Getenv("REDIS_MODE")
+	}
+	if os.Getenv("REDIS_ADDRS") != "" {
+		cfg.Addrs = strings.Split(os.Getenv("REDIS_ADDRS"), ",")
+	} else if os.Getenv("REDIS_HOST") != "" || len(cfg.Addrs) == 0 {
+		cfg.Addrs = []string{fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT"))}
+	}
+	if os.Getenv("REDIS_MASTER_NAME") != "" {
+		cfg.MasterName = os.Getenv("REDIS_MASTER_NAME")
+	}
+	if os.Getenv("REDIS_USERNAME") != "" {
+		cfg.Username = os.Getenv("REDIS_USERNAME")
+	}
+	if os.Getenv("REDIS_PASSWORD") != "" {
+		cfg.Password = os.Getenv("REDIS_PASSWORD")
+	}
+	if f := os.Getenv("REDIS_PASSWORD_FILE"); f != "" {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Password = strings.TrimSpace(string(data))
+	}
+	var err error
+	if os.Getenv("REDIS_DB") != "" {
+		cfg.DB, err = strconv.Atoi(os.Getenv("REDIS_DB"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if os.Getenv("REDIS_TLS") != "" {
+		cfg.TLS = os.Getenv("REDIS_TLS") == "true"
+	}
+	if os.Getenv("REDIS_TLS_CA_FILE") != "" {
+		cfg.TLSCAFile = os.Getenv("REDIS_TLS_CA_FILE")
+	}
+	if os.Getenv("REDIS_TLS_CERT_FILE") != "" {
+		cfg.TLSCertFile = os.Getenv("REDIS_TLS_CERT_FILE")
+	}
+	if os.Getenv("REDIS_TLS_KEY_FILE") != "" {
+		cfg.TLSKeyFile = os.Getenv("REDIS_TLS_KEY_FILE")
+	}
+	if os.Getenv("REDIS_TLS_SERVER_NAME") != "" {
+		cfg.TLSServerName = os.Getenv("REDIS_TLS_SERVER_NAME")
+	}
+	if os.Getenv("REDIS_TLS_INSECURE_SKIP_VERIFY") != "" {
+		cfg.TLSInsecureSkipVerify = os.Getenv("REDIS_TLS_INSECURE_SKIP_VERIFY") == "true"
+	}
+	for env, d := range map[string]*time.Duration{
+		"REDIS_DIAL_TIMEOUT":  &cfg.DialTimeout,
+		"REDIS_READ_TIMEOUT":  &cfg.ReadTimeout,
+		"REDIS_WRITE_TIMEOUT": &cfg.WriteTimeout,
+	} {
+		if os.Getenv(env) != "" {
+			*d, err = time.ParseDuration(os.Getenv(env))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = redisModeSingle
+	}
+	return cfg, nil
+}
+
+func (cfg *redisConfig) tlsConfig() (*tls.Config, error) {
+	if !cfg.TLS {
+		return nil, nil
+	}
+	tc := &tls.Config{
+		ServerName:         cfg.TLSServerName,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+	}
+	if cfg.TLSCAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in " + cfg.TLSCAFile)
+		}
+	}
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// aclOnConnect authenticates with a redis 6 ACL user. go-redis only sends a
+// password on its own, so the AUTH and SELECT are issued on each new
+// connection instead.
+func (cfg *redisConfig) aclOnConnect(db int) func(*redis.Conn) error {
+	return func(cn *redis.Conn) error {
+		auth := redis.NewStatusCmd("auth", cfg.Username, cfg.Password)
+		if err := cn.Process(auth); err != nil {
+			return err
+		}
+		if db > 0 {
+			return cn.Select(db).Err()
+		}
+		return nil
+	}
+}
+
+func newRedisClient(cfg *redisConfig) (redis.UniversalClient, error) {
+	tc, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	password := cfg.Password
+	db := cfg.DB
+	var onConnect func(*redis.Conn) error
+	if cfg.Username != "" {
+		onConnect = cfg.aclOnConnect(db)
+		password = ""
+		db = 0
+	}
+	switch cfg.Mode {
+	case redisModeSingle:
+		return redis.NewClient(&redis.Options{
+			Addr:      cfg.Addrs[0],
+			Password:  password,
+			DB:        db,
+			OnConnect: onConnect,
+			TLSConfig: tc,
+
+			DialTimeout:  cfg.DialTimeout,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+		}), nil
+	case redisModeSentinel:
+		if cfg.MasterName == "" {
+			return nil, errors.New("sentinel mode requires a master name")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cfg.MasterName,
+			SentinelAddrs: cfg.Addrs,
+			Password:      password,
+			DB:            db,
+			OnConnect:     onConnect,
+			TLSConfig:     tc,
+
+			DialTimeout:  cfg.DialTimeout,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+		}), nil
+	case redisModeCluster:
+		if cfg.DB != 0 {
+			return nil, errors.New("redis cluster does not support selecting a db")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     cfg.Addrs,
+			Password:  password,
+			OnConnect: onConnect,
+			TLSConfig: tc,
+
+			DialTimeout:  cfg.DialTimeout,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown redis mode %q", cfg.Mode)
+}
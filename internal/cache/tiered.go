@@ -0,0 +1,182 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	invalidationChannel = "ethlb:cache:invalidate"
+)
+
+// tieredCache serves reads from a local LRU and falls back to the shared
+// remote cache, populating the local tier on remote hits. Local entries are
+// capped at localTTL so replicas do not drift far from the shared state, and
+// deletes are broadcast so other replicas drop their local copies.
+type tieredCache struct {
+	local    *lruCache
+	remote   Cache
+	localTTL time.Duration
+	origin   string
+}
+
+// ttlCache is a Cache which can report how long an entry has left.
+type ttlCache interface {
+	GetTTL(key string) (string, time.Duration, error)
+}
+
+type invalidation struct {
+	Origin string   `json:"origin"`
+	Keys   []string `json:"keys"`
+}
+
+func (c *tieredCache) localExp(exp time.Duration) time.Duration {
+	if exp <= 0 || exp > c.localTTL {
+		return c.localTTL
+	}
+	return exp
+}
+
+// listen drops local entries deleted by other replicas.
+func (c *tieredCache) listen() error {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+		"channel": invalidationChannel,
+	})
+	if os.Getenv("CACHE_INVALIDATION_CHANNEL") != "" {
+		invalidationChannel = os.Getenv("CACHE_INVALIDATION_CHANNEL")
+	}
+	c.origin = fmt.Sprintf("%d-%x", os.Getpid(), rand.New(rand.NewSource(time.Now().UnixNano())).Uint32())
+	ps, err := Subscribe(invalidationChannel)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for msg := range ps.Channel() {
+			inv := &invalidation{}
+			if err := json.Unmarshal([]byte(msg.Payload), inv); err != nil {
+				l.WithError(err).Error("Failed to unmarshal invalidation")
+				continue
+			}
+			if inv.Origin == c.origin {
+				continue
+			}
+			l.WithField("keys", len(inv.Keys)).Debug("Dropping invalidated local entries")
+			c.local.Del(inv.Keys...)
+		}
+	}()
+	return nil
+}
+
+func (c *tieredCache) Get(key string) (string, error) {
+	l := log.WithFields(log.Fields{
+		"package": "cache",
+	})
+	if v, _ := c.local.Get(key); v != "" {
+		l.Debug("Local cache hit")
+		return v, nil
+	}
+	// local copies expire with the remote entry, so short lived entries
+	// are not served past their expiry by other replicas
+	var v string
+	var exp time.Duration
+	var err error
+	if tc, ok := c.remote.(ttlCache); ok {
+		v, exp, err = tc.GetTTL(key)
+	} else {
+		v, err = c.remote.Get(key)
+	}
+	if err != nil || v == "" {
+		return v, err
+	}
+	if err := c.local.Set(key, v, c.localExp(exp)); err != nil {
+		l.WithError(err).Error("Failed to populate local cache")
+	}
+	return v, nil
+}
+
+func (c *tieredCache) Set(key string, value string, exp time.Duration) error {
+	if err := c.local.Set(key, value, c.localExp(exp)); err != nil {
+		return err
+	}
+	return c.remote.Set(key, value, exp)
+}
+
+func (c *tieredCache) Del(keys ...string) error {
+	if err := c.local.Del(keys...); err != nil {
+		return err
+	}
+	if err := c.remote.Del(keys...); err != nil {
+		return err
+	}
+	jd, err := json.Marshal(&invalidation{Origin: c.origin, Keys: keys})
+	if err != nil {
+		return err
+	}
+	return Publish(invalidationChannel, string(jd))
+}
+
+func (c *tieredCache) AddToIndex(index string, key string, exp time.Duration) error {
+	if err := c.local.AddToIndex(index, key, c.localExp(exp)); err != nil {
+		return err
+	}
+	return c.remote.AddToIndex(index, key, exp)
+}
+
+// IndexMembers returns the union of the local and remote index so entries
+// only present in the local tier are found as well.
+func (c *tieredCache) IndexMembers(index string) ([]string, error) {
+	lm, err := c.local.IndexMembers(index)
+	if err != nil {
+		return nil, err
+	}
+	rm, err := c.remote.IndexMembers(index)
+	if err != nil && err != ErrUnavailable {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(lm))
+	for _, k := range lm {
+		seen[k] = true
+	}
+	for _, k := range rm {
+		if !seen[k] {
+			lm = append(lm, k)
+		}
+	}
+	return lm, nil
+}
+
+// Scan visits local keys first and then remote keys not held locally.
+func (c *tieredCache) Scan(prefix string, fn func(keys []string) error) error {
+	seen := make(map[string]bool)
+	err := c.local.Scan(prefix, func(keys []string) error {
+		for _, k := range keys {
+			seen[k] = true
+		}
+		return fn(keys)
+	})
+	if err != nil {
+		return err
+	}
+	err = c.remote.Scan(prefix, func(keys []string) error {
+		var rk []string
+		for _, k := range keys {
+			if !seen[k] {
+				rk = append(rk, k)
+			}
+		}
+		if len(rk) == 0 {
+			return nil
+		}
+		return fn(rk)
+	})
+	if err == ErrUnavailable {
+		return nil
+	}
+	return err
+}
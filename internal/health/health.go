@@ -0,0 +1,90 @@
+package health
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Check reports an error when the component it covers is unhealthy.
+type Check func() error
+
+var (
+	mu     sync.RWMutex
+	checks = make(map[string]Check)
+	// readiness checks must pass for the process to receive traffic
+	readiness = make(map[string]Check)
+	// shuttingDown is set once shutdown starts, so the replica is taken
+	// out of rotation while it drains
+	shuttingDown int32
+)
+
+var ErrShuttingDown = errors.New("shutting down")
+
+// SetShuttingDown marks the process as shutting down.
+func SetShuttingDown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+}
+
+// ShuttingDown reports whether shutdown has started.
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// Register adds a named check, replacing any existing check with that name.
+func Register(name string, c Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks[name] = c
+}
+
+// Names returns the names of all registered checks in sorted order.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(checks))
+	for n := range checks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Status runs all registered checks and returns the failing ones by name.
+func Status() map[string]error {
+	mu.RLock()
+	defer mu.RUnlock()
+	failed := make(map[string]error)
+	for n, c := range checks {
+		if err := c(); err != nil {
+			failed[n] = err
+		}
+	}
+	return failed
+}
+
+// RegisterReadiness adds a named readiness check, replacing any existing
+// readiness check with that name.
+func RegisterReadiness(name string, c Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	readiness[name] = c
+}
+
+// Readiness runs all readiness checks and returns the failing ones by name.
+// While shutting down, it always fails with ErrShuttingDown.
+func Readiness() map[string]error {
+	mu.RLock()
+	defer mu.RUnlock()
+	failed := make(map[string]error)
+	if ShuttingDown() {
+		failed["shutdown"] = ErrShuttingDown
+	}
+	for n, c := range readiness {
+		if err := c(); err != nil {
+			failed[n] = err
+		}
+	}
+	return failed
+}
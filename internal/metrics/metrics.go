@@ -4,9 +4,13 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/ethlb/internal/health"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -39,6 +43,13 @@ var (
 		},
 		[]string{"chain", "code", "method"},
 	)
+	CacheAvailable = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: os.Getenv("PROMETHEUS_NAMESPACE"),
+			Name:      "cache_available",
+			Help:      "A boolean indicating whether the cache backend is reachable",
+		},
+	)
 	Cooldowns = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: os.Getenv("PROMETHEUS_NAMESPACE"),
@@ -63,6 +74,64 @@ var (
 		},
 		[]string{"chain", "endpoint"},
 	)
+	APIKeyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: os.Getenv("PROMETHEUS_NAMESPACE"),
+			Name:      "api_key_requests_total",
+			Help:      "Total number of JSON-RPC calls by api key, chain, and method, with unknown methods counted as other",
+		},
+		[]string{"key", "chain", "method"},
+	)
+	RateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: os.Getenv("PROMETHEUS_NAMESPACE"),
+			Name:      "rate_limited_total",
+			Help:      "Total number of HTTP requests rejected by rate limits by chain and api key",
+		},
+		[]string{"chain", "key"},
+	)
+	MethodRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: os.Getenv("PROMETHEUS_NAMESPACE"),
+			Name:      "method_rejected_total",
+			Help:      "Total number of JSON-RPC calls rejected by method policies by chain, matched rule, and policy",
+		},
+		[]string{"chain", "rule", "policy"},
+	)
+	EndpointInflight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: os.Getenv("PROMETHEUS_NAMESPACE"),
+			Name:      "endpoint_inflight_requests",
+			Help:      "The number of requests in flight to the endpoint",
+		},
+		[]string{"chain", "endpoint"},
+	)
+	UpstreamConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: os.Getenv("PROMETHEUS_NAMESPACE"),
+			Name:      "upstream_connections_total",
+			Help:      "Total number of connections used for upstream requests by chain, endpoint, and whether they were reused",
+		},
+		[]string{"chain", "endpoint", "reused"},
+	)
+	UpstreamConnectDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: os.Getenv("PROMETHEUS_NAMESPACE"),
+		Name:      "upstream_connect_duration_seconds",
+		Help:      "Histogram of new upstream connection setup time in seconds by chain, endpoint, and phase",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"chain", "endpoint", "phase"})
+	UpstreamRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: os.Getenv("PROMETHEUS_NAMESPACE"),
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Histogram of upstream response time in seconds by chain and endpoint",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"chain", "endpoint"})
+	ReorgDepth = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: os.Getenv("PROMETHEUS_NAMESPACE"),
+		Name:      "chain_reorg_depth",
+		Help:      "Histogram of detected chain reorg depths in blocks",
+		Buckets:   []float64{1, 2, 3, 5, 8, 13, 21, 34, 64},
+	}, []string{"chain"})
 	responseTimeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: os.Getenv("PROMETHEUS_NAMESPACE"),
 		Name:      "http_server_request_duration_seconds",
@@ -82,9 +151,18 @@ func registerMetrics() error {
 		responseTimeHistogram,
 		CacheHit,
 		CacheMiss,
+		CacheAvailable,
 		Cooldowns,
 		EndpointEnabled,
 		EndpointBlockHead,
+		ReorgDepth,
+		APIKeyRequests,
+		RateLimited,
+		EndpointInflight,
+		MethodRejected,
+		UpstreamConnections,
+		UpstreamConnectDuration,
+		UpstreamRequestDuration,
 	)
 	return nil
 }
@@ -99,6 +177,25 @@ func (rec *statusRecorder) WriteHeader(statusCode int) {
 	rec.ResponseWriter.WriteHeader(statusCode)
 }
 
+// URLLabel returns the request URL for use as a metric label, with any API
+// key in the path redacted. The path is rebuilt from the matched route so
+// only the key segment is replaced.
+func URLLabel(r *http.Request) string {
+	vars := mux.Vars(r)
+	if vars["key"] == "" {
+		return r.URL.String()
+	}
+	u := *r.URL
+	u.RawPath = ""
+	u.Path = "/" + vars["chain"] + "/redacted"
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			u.Path = strings.NewReplacer("{chain}", vars["chain"], "{key}", "redacted").Replace(tpl)
+		}
+	}
+	return u.String()
+}
+
 func MeasureResponseDuration(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -106,7 +203,7 @@ func MeasureResponseDuration(next http.Handler) http.Handler {
 		next.ServeHTTP(&rec, r)
 		duration := time.Since(start)
 		statusCode := strconv.Itoa(rec.statusCode)
-		responseTimeHistogram.WithLabelValues(r.URL.String(), r.Method, statusCode).Observe(duration.Seconds())
+		responseTimeHistogram.WithLabelValues(URLLabel(r), r.Method, statusCode).Observe(duration.Seconds())
 	})
 }
 
@@ -123,8 +220,45 @@ func StartExporter() error {
 	}
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/statusz", func(w http.ResponseWriter, r *http.Request) {
+		if health.ShuttingDown() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "shutting down")
+			return
+		}
+		failed := health.Status()
+		if len(failed) == 0 {
+			fmt.Fprint(w, "ok")
+			return
+		}
+		// degraded components are reported but do not fail the check,
+		// ethlb keeps serving with them bypassed
+		fmt.Fprint(w, "degraded")
+		for _, n := range health.Names() {
+			if err, ok := failed[n]; ok {
+				fmt.Fprintf(w, "\n%s: %s", n, err)
+			}
+		}
+	})
+	http.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "ok")
 	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		failed := health.Readiness()
+		if len(failed) == 0 {
+			fmt.Fprint(w, "ok")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "not ready")
+		names := make([]string, 0, len(failed))
+		for n := range failed {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Fprintf(w, "\n%s: %s", n, failed[n])
+		}
+	})
 	var promPort = "9090"
 	if os.Getenv("PROMETHEUS_PORT") != "" {
 		promPort = os.Getenv("PROMETHEUS_PORT")
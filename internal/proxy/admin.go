@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/cache"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxPurgeBlocks bounds block range purges
+	maxPurgeBlocks = 10000
+)
+
+var (
+	cacheStatsMu sync.Mutex
+	cacheStats   = make(map[string]*chainCacheStats)
+)
+
+type chainCacheStats struct {
+	hits   uint64
+	misses uint64
+}
+
+type CacheEntryInfo struct {
+	Key         string          `json:"key"`
+	Found       bool            `json:"found"`
+	StatusCode  int             `json:"statusCode,omitempty"`
+	Endpoint    string          `json:"endpoint,omitempty"`
+	BlockHeight uint64          `json:"blockHeight,omitempty"`
+	CreatedAt   *time.Time      `json:"createdAt,omitempty"`
+	AgeSeconds  float64         `json:"ageSeconds,omitempty"`
+	Stale       bool            `json:"stale,omitempty"`
+	SoftExpiry  *time.Time      `json:"softExpiry,omitempty"`
+	HardExpiry  *time.Time      `json:"hardExpiry,omitempty"`
+	Header      http.Header     `json:"header,omitempty"`
+	Body        json.RawMessage `json:"body,omitempty"`
+}
+
+type ChainCacheStats struct {
+	Chain    string  `json:"chain"`
+	Entries  int     `json:"entries"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hitRatio"`
+}
+
+func statsFor(chainName string) *chainCacheStats {
+	cacheStatsMu.Lock()
+	defer cacheStatsMu.Unlock()
+	s, ok := cacheStats[chainName]
+	if !ok {
+		s = &chainCacheStats{}
+		cacheStats[chainName] = s
+	}
+	return s
+}
+
+func recordCacheHit(chainName string) {
+	atomic.AddUint64(&statsFor(chainName).hits, 1)
+}
+
+func recordCacheMiss(chainName string) {
+	atomic.AddUint64(&statsFor(chainName).misses, 1)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("failed to write json response")
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// adminAuthorized checks the bearer token against ADMIN_TOKEN. Without a
+// token configured the read only admin endpoints are open, relying on the
+// metrics port not being exposed publicly.
+func adminAuthorized(r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return true
+	}
+	got := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) == 1
+}
+
+// requestCacheKey returns the cache key named by the key query parameter or
+// derived from the chain, method and params parameters.
+func requestCacheKey(r *http.Request) (string, error) {
+	q := r.URL.Query()
+	if q.Get("key") != "" {
+		return q.Get("key"), nil
+	}
+	if q.Get("chain") == "" || q.Get("method") == "" {
+		return "", errors.New("key or chain and method are required")
+	}
+	rr := &rpcRequest{
+		Calls: []*JSONRPCRequest{{
+			Method: q.Get("method"),
+			Params: json.RawMessage(q.Get("params")),
+		}},
+	}
+	return rr.cacheKey(q.Get("chain"))
+}
+
+// lookupCacheEntry describes the cache entry at key. Cached headers and
+// bodies are only included with withBody, since they may hold data of other
+// clients.
+func lookupCacheEntry(key string, withBody bool) (*CacheEntryInfo, error) {
+	info := &CacheEntryInfo{Key: key}
+	cd, err := cache.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if cd == "" {
+		return info, nil
+	}
+	info.Found = true
+	e, err := cache.DecodeEntry(cd)
+	if err != nil {
+		// legacy and unknown entries can still be purged by key
+		return info, nil
+	}
+	info.StatusCode = e.StatusCode
+	// endpoint URLs can carry provider API keys
+	info.Endpoint = endpointHost(e.Endpoint)
+	info.BlockHeight = e.BlockHeight
+	info.CreatedAt = &e.CreatedAt
+	info.AgeSeconds = time.Since(e.CreatedAt).Seconds()
+	info.Stale = e.Stale(time.Now())
+	if !e.SoftExpiry.IsZero() {
+		info.SoftExpiry = &e.SoftExpiry
+		info.HardExpiry = &e.HardExpiry
+	}
+	if !withBody {
+		return info, nil
+	}
+	info.Header = e.Header
+	if json.Valid(e.Body) {
+		info.Body = e.Body
+	}
+	return info, nil
+}
+
+func purgeCache(r *http.Request) (int, error) {
+	l := log.WithFields(log.Fields{
+		"action": "purgeCache",
+		"query":  r.URL.RawQuery,
+	})
+	q := r.URL.Query()
+	chainName := q.Get("chain")
+	switch {
+	case q.Get("key") != "" || (chainName != "" && q.Get("params") != ""):
+		key, err := requestCacheKey(r)
+		if err != nil {
+			return 0, err
+		}
+		l.WithField("key", key).Info("purging cache entry")
+		return 1, cache.Del(key)
+	case chainName != "" && (q.Get("fromBlock") != "" || q.Get("toBlock") != ""):
+		from, ferr := strconv.ParseUint(q.Get("fromBlock"), 0, 64)
+		to, terr := strconv.ParseUint(q.Get("toBlock"), 0, 64)
+		if ferr != nil || terr != nil || to < from {
+			return 0, errors.New("fromBlock and toBlock must be a valid block range")
+		}
+		if to-from >= maxPurgeBlocks {
+			return 0, errors.New("block range exceeds " + strconv.Itoa(maxPurgeBlocks) + " blocks")
+		}
+		var heights []uint64
+		for n := from; n <= to; n++ {
+			heights = append(heights, n)
+		}
+		l.Info("purging cache block range")
+		return invalidateBlocks(chainName, heights), nil
+	case chainName != "" && q.Get("method") != "":
+		l.Info("purging cache method")
+		return cache.DelPrefix(chainName + ":" + q.Get("method") + ":")
+	case chainName != "":
+		l.Info("purging cache chain")
+		return cache.DelPrefix(chainName + ":")
+	case q.Get("method") != "":
+		l.Info("purging cache method on all chains")
+		var n int
+		for _, c := range Chains {
+			cn, err := cache.DelPrefix(c.Name + ":" + q.Get("method") + ":")
+			n += cn
+			if err != nil {
+				return n, err
+			}
+		}
+		return n, nil
+	}
+	return 0, errors.New("key, chain or method is required")
+}
+
+// CacheAdminHandler looks up (GET) or purges (DELETE) cache entries.
+//
+// Entries are selected by key, or by chain, method and params. Purges also
+// accept a whole chain, a method on one or all chains, or a chain and a
+// fromBlock/toBlock range.
+func CacheAdminHandler(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"action": "CacheAdminHandler",
+		"method": r.Method,
+	})
+	l.Debug("start")
+	defer l.Debug("end")
+	if !adminAuthorized(r) {
+		writeAdminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		key, err := requestCacheKey(r)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		// without ADMIN_TOKEN the lookup is open, so only metadata is shown
+		info, err := lookupCacheEntry(key, os.Getenv("ADMIN_TOKEN") != "")
+		if err != nil {
+			l.WithError(err).Error("failed to look up cache entry")
+			writeAdminError(w, http.StatusBadGateway, err)
+			return
+		}
+		code := http.StatusOK
+		if !info.Found {
+			code = http.StatusNotFound
+		}
+		writeJSON(w, code, info)
+	case http.MethodDelete:
+		if os.Getenv("ADMIN_TOKEN") == "" {
+			writeAdminError(w, http.StatusForbidden, errors.New("purging requires ADMIN_TOKEN to be set"))
+			return
+		}
+		n, err := purgeCache(r)
+		if err != nil {
+			l.WithError(err).Error("failed to purge cache")
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// CacheStatsHandler reports the number of cached entries and the hit ratio
+// of this replica for each chain.
+func CacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"action": "CacheStatsHandler",
+	})
+	l.Debug("start")
+	defer l.Debug("end")
+	if !adminAuthorized(r) {
+		writeAdminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	var stats []*ChainCacheStats
+	for _, c := range Chains {
+		if r.URL.Query().Get("chain") != "" && r.URL.Query().Get("chain") != c.Name {
+			continue
+		}
+		cs := &ChainCacheStats{Chain: c.Name}
+		err := cache.Scan(c.Name+":", func(keys []string) error {
+			cs.Entries += len(keys)
+			return nil
+		})
+		if err != nil {
+			l.WithError(err).Error("failed to count cache entries")
+			writeAdminError(w, http.StatusBadGateway, err)
+			return
+		}
+		s := statsFor(c.Name)
+		cs.Hits = atomic.LoadUint64(&s.hits)
+		cs.Misses = atomic.LoadUint64(&s.misses)
+		if cs.Hits+cs.Misses > 0 {
+			cs.HitRatio = float64(cs.Hits) / float64(cs.Hits+cs.Misses)
+		}
+		stats = append(stats, cs)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Chain < stats[j].Chain
+	})
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/cache"
+)
+
+func TestPurgeCache(t *testing.T) {
+	entries := []string{
+		"ethereum:eth_getBlockByNumber:a",
+		"ethereum:eth_getBlockByNumber:b",
+		"ethereum:eth_chainId:a",
+		"polygon:eth_getBlockByNumber:a",
+		"polygon:eth_call:a",
+		"removed:eth_getBlockByNumber:a",
+	}
+	tests := []struct {
+		name      string
+		query     string
+		wantN     int
+		wantErr   bool
+		remaining []string
+	}{
+		{
+			name:      "key",
+			query:     "key=ethereum:eth_chainId:a",
+			wantN:     1,
+			remaining: []string{"ethereum:eth_getBlockByNumber:a", "ethereum:eth_getBlockByNumber:b", "polygon:eth_call:a", "polygon:eth_getBlockByNumber:a", "removed:eth_getBlockByNumber:a"},
+		},
+		{
+			name:      "chain and method",
+			query:     "chain=ethereum&method=eth_getBlockByNumber",
+			wantN:     2,
+			remaining: []string{"ethereum:eth_chainId:a", "polygon:eth_call:a", "polygon:eth_getBlockByNumber:a", "removed:eth_getBlockByNumber:a"},
+		},
+		{
+			name:      "chain",
+			query:     "chain=polygon",
+			wantN:     2,
+			remaining: []string{"ethereum:eth_chainId:a", "ethereum:eth_getBlockByNumber:a", "ethereum:eth_getBlockByNumber:b", "removed:eth_getBlockByNumber:a"},
+		},
+		{
+			name:      "method on configured chains",
+			query:     "method=eth_getBlockByNumber",
+			wantN:     3,
+			remaining: []string{"ethereum:eth_chainId:a", "polygon:eth_call:a", "removed:eth_getBlockByNumber:a"},
+		},
+		{
+			name:    "invalid block range",
+			query:   "chain=ethereum&fromBlock=10&toBlock=9",
+			wantErr: true,
+		},
+		{
+			name:    "block range too large",
+			query:   "chain=ethereum&fromBlock=0&toBlock=10000",
+			wantErr: true,
+		},
+		{
+			name:    "nothing selected",
+			query:   "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestChains(t, `[{"name":"ethereum","endpoints":[]},{"name":"polygon","endpoints":[]}]`)
+			for _, k := range entries {
+				if err := cache.Set(k, "v", time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			}
+			n, err := purgeCache(httptest.NewRequest("DELETE", "/admin/cache?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("purgeCache() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if n != tt.wantN {
+				t.Errorf("purgeCache() = %d, want %d", n, tt.wantN)
+			}
+			var remaining []string
+			cache.Scan("", func(keys []string) error {
+				remaining = append(remaining, keys...)
+				return nil
+			})
+			sort.Strings(remaining)
+			if !reflect.DeepEqual(remaining, tt.remaining) {
+				t.Errorf("remaining entries = %v, want %v", remaining, tt.remaining)
+			}
+		})
+	}
+}
+
+func TestPurgeCacheBlockRange(t *testing.T) {
+	defer func(depth uint64) { reorgTrackDepth = depth }(reorgTrackDepth)
+	reorgTrackDepth = 64
+	useTestChains(t, `[{"name":"ethereum","endpoints":[]}]`)
+	for n := uint64(10); n <= 12; n++ {
+		key := blockCacheKey(t, "ethereum", "eth_getBlockByNumber", `["`+fmt.Sprintf("0x%x", n)+`",false]`)
+		if err := cache.Set(key, "v", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.AddToIndex(blockIndexName("ethereum", n), key, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := purgeCache(httptest.NewRequest("DELETE", "/admin/cache?chain=ethereum&fromBlock=11&toBlock=0x14", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("purgeCache() = %d, want 2", n)
+	}
+	if v, _ := cache.Get(blockCacheKey(t, "ethereum", "eth_getBlockByNumber", `["0xa",false]`)); v == "" {
+		t.Error("block 10 was purged")
+	}
+}
+
+func TestCacheAdminLookupBody(t *testing.T) {
+	useTestChains(t, `[{"name":"ethereum","endpoints":[]}]`)
+	e := &cache.Entry{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       []byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`),
+		Endpoint:   "https://provider.example/v3/s3cret",
+		CreatedAt:  time.Now(),
+	}
+	cd, err := e.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("ethereum:eth_chainId:a", cd, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		token    string
+		auth     string
+		wantCode int
+		wantBody bool
+	}{
+		{
+			name:     "no token shows metadata only",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "token required",
+			token:    "t",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "token shows the body",
+			token:    "t",
+			auth:     "Bearer t",
+			wantCode: http.StatusOK,
+			wantBody: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_TOKEN", tt.token)
+			r := httptest.NewRequest("GET", "/admin/cache?key=ethereum:eth_chainId:a", nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			CacheAdminHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			info := &CacheEntryInfo{}
+			if err := json.Unmarshal(w.Body.Bytes(), info); err != nil {
+				t.Fatal(err)
+			}
+			if !info.Found || info.StatusCode != http.StatusOK || info.Endpoint != "provider.example" {
+				t.Errorf("info = %+v, want the entry's metadata", info)
+			}
+			if gotBody := info.Body != nil || info.Header != nil; gotBody != tt.wantBody {
+				t.Errorf("body shown = %v, want %v", gotBody, tt.wantBody)
+			}
+		})
+	}
+}
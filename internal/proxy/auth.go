@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/robertlestak/ethlb/internal/auth"
+	"github.com/robertlestak/ethlb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// readRPCRequest parses the JSON-RPC request in the body of r, leaving the
+// body in place to be proxied. Bodies over maxRequestBodyBytes are not read
+// in full and return errRequestTooLarge.
+func readRPCRequest(r *http.Request) (*rpcRequest, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > maxRequestBodyBytes {
+		return nil, errRequestTooLarge
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return parseRPCRequest(b)
+}
+
+// authorizeRequest checks the request's API key, from the path or the
+// x-api-key header, against the chain and the methods called. It writes an
+// error response and returns false if the request is rejected. The key is
+// nil when API keys are disabled.
+func authorizeRequest(w http.ResponseWriter, r *http.Request, chain string, rr *rpcRequest) (*auth.Key, bool) {
+	l := log.WithFields(log.Fields{
+		"chain":  chain,
+		"action": "authorizeRequest",
+	})
+	key := mux.Vars(r)["key"]
+	if key == "" {
+		key = r.Header.Get(auth.Header)
+	}
+	k, err := auth.Authenticate(key)
+	if err != nil {
+		l.WithError(err).Debug("rejected api key")
+		writeRPCError(w, http.StatusUnauthorized, rpcErrUnauthorized, err.Error())
+		return nil, false
+	}
+	if k == nil {
+		return nil, true
+	}
+	l = l.WithField("apiKey", k.Label())
+	if !k.AllowsChain(chain) {
+		l.Debug("chain not allowed for api key")
+		writeRPCError(w, http.StatusForbidden, rpcErrUnauthorized, "chain not allowed for api key")
+		return nil, false
+	}
+	if rr == nil {
+		metrics.APIKeyRequests.WithLabelValues(k.Label(), chain, "invalid").Inc()
+		return k, true
+	}
+	for _, c := range rr.Calls {
+		metrics.APIKeyRequests.WithLabelValues(k.Label(), chain, methodLabel(c.Method)).Inc()
+	}
+	return k, true
+}
+
+type namedPolicy struct {
+	name   string
+	policy *auth.MethodPolicy
+}
+
+// checkMethodPolicy rejects requests calling methods denied by the default,
+// chain or API key method policy. Non-empty bodies which can't be parsed
+// can't be checked, and are rejected if the chain or key has a policy of its
+// own. It writes an error response and returns false if the request is
+// rejected.
+func checkMethodPolicy(w http.ResponseWriter, r *http.Request, chainName string, k *auth.Key, rr *rpcRequest, perr error) bool {
+	l := log.WithFields(log.Fields{
+		"chain":  chainName,
+		"action": "checkMethodPolicy",
+	})
+	policies := []namedPolicy{
+		{"default", auth.DefaultPolicy},
+	}
+	for _, c := range Chains {
+		if c.Name == chainName {
+			policies = append(policies, namedPolicy{"chain", c.Methods})
+		}
+	}
+	if k != nil {
+		policies = append(policies, namedPolicy{"key", k.Policy()})
+	}
+	if rr == nil {
+		if perr == errEmptyRequest || !hasOwnPolicy(policies) {
+			return true
+		}
+		l.WithError(perr).Debug("rejected invalid request")
+		metrics.MethodRejected.WithLabelValues(chainName, "invalid", "invalid").Inc()
+		writeRPCError(w, http.StatusBadRequest, rpcErrInvalidRequest, "invalid json-rpc request")
+		return false
+	}
+	for _, c := range rr.Calls {
+		for _, p := range policies {
+			rule, denied := p.policy.DeniedBy(c.Method)
+			if !denied {
+				continue
+			}
+			l.WithFields(log.Fields{
+				"rpcMethod": c.Method,
+				"policy":    p.name,
+				"rule":      rule,
+			}).Debug("method rejected")
+			metrics.MethodRejected.WithLabelValues(chainName, rule, p.name).Inc()
+			writeRPCError(w, http.StatusForbidden, rpcErrMethodNotFound, "method "+c.Method+" is not allowed")
+			return false
+		}
+	}
+	return true
+}
+
+// hasOwnPolicy reports whether a chain or key policy restricts methods
+// beyond the default policy.
+func hasOwnPolicy(policies []namedPolicy) bool {
+	for _, p := range policies {
+		if p.name != "default" && !p.policy.Empty() {
+			return true
+		}
+	}
+	return false
+}
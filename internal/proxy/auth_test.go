@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/robertlestak/ethlb/internal/auth"
+)
+
+func TestCheckMethodPolicy(t *testing.T) {
+	prev := Chains
+	defer func() { Chains = prev }()
+	Chains = []*chain{
+		{Name: "open"},
+		{Name: "restricted", Methods: &auth.MethodPolicy{Allow: []string{"eth_*"}}},
+	}
+	tests := []struct {
+		name     string
+		chain    string
+		key      *auth.Key
+		body     string
+		wantCode int
+	}{
+		{
+			name:  "allowed call",
+			chain: "open",
+			body:  `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`,
+		},
+		{
+			name:     "default policy applies to every chain",
+			chain:    "open",
+			body:     `{"jsonrpc":"2.0","id":1,"method":"admin_peers"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "chain policy",
+			chain:    "restricted",
+			body:     `{"jsonrpc":"2.0","id":1,"method":"debug_traceTransaction"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "blocked call in a batch",
+			chain:    "restricted",
+			body:     `[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"},{"jsonrpc":"2.0","id":2,"method":"net_version"}]`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "key policy",
+			chain:    "open",
+			key:      &auth.Key{DenyMethods: []string{"eth_sendRawTransaction"}},
+			body:     `{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["0x00"]}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:  "invalid body without a chain or key policy",
+			chain: "open",
+			body:  `not json`,
+		},
+		{
+			name:  "invalid body with an empty key policy",
+			chain: "open",
+			key:   &auth.Key{},
+			body:  `not json`,
+		},
+		{
+			name:     "invalid body with a chain policy",
+			chain:    "restricted",
+			body:     `not json`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid body with a key policy",
+			chain:    "open",
+			key:      &auth.Key{Methods: []string{"eth_*"}},
+			body:     `not json`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:  "empty body",
+			chain: "restricted",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, perr := parseRPCRequest([]byte(tt.body))
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/"+tt.chain, nil)
+			ok := checkMethodPolicy(w, r, tt.chain, tt.key, rr, perr)
+			if ok != (tt.wantCode == 0) {
+				t.Fatalf("checkMethodPolicy() = %v, want %v", ok, tt.wantCode == 0)
+			}
+			if !ok && w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// blockParamIndex is the position of the block number or tag parameter for
+// methods which take one.
+var blockParamIndex = map[string]int{
+	"eth_getBlockByNumber":                    0,
+	"eth_getBlockTransactionCountByNumber":    0,
+	"eth_getUncleCountByBlockNumber":          0,
+	"eth_getTransactionByBlockNumberAndIndex": 0,
+	"eth_getUncleByBlockNumberAndIndex":       0,
+	"eth_getBlockReceipts":                    0,
+	"eth_getBalance":                          1,
+	"eth_getCode":                             1,
+	"eth_getTransactionCount":                 1,
+	"eth_call":                                1,
+	"eth_estimateGas":                         1,
+	"eth_getStorageAt":                        2,
+	"eth_getProof":                            2,
+}
+
+// blockRef is a block referenced by a call, either by number or by a tag
+// such as "latest".
+type blockRef struct {
+	Number uint64
+	Tag    string
+	Hash   string
+}
+
+func parseHexUint(s string) (uint64, bool) {
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "0X") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s[2:], 16, 64)
+	return n, err == nil
+}
+
+// parseBlockRef parses a block parameter, which may be a hex number, a tag,
+// or an EIP-1898 object with blockNumber or blockHash.
+func parseBlockRef(raw json.RawMessage) *blockRef {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if n, ok := parseHexUint(s); ok {
+			return &blockRef{Number: n}
+		}
+		return &blockRef{Tag: s}
+	}
+	var o struct {
+		BlockNumber string `json:"blockNumber"`
+		BlockHash   string `json:"blockHash"`
+	}
+	if err := json.Unmarshal(raw, &o); err != nil {
+		return nil
+	}
+	if o.BlockHash != "" {
+		return &blockRef{Hash: o.BlockHash}
+	}
+	if o.BlockNumber != "" {
+		return parseBlockRef(json.RawMessage(strconv.Quote(o.BlockNumber)))
+	}
+	return nil
+}
+
+func (c *JSONRPCRequest) params() []json.RawMessage {
+	var p []json.RawMessage
+	if err := json.Unmarshal(c.Params, &p); err != nil {
+		return nil
+	}
+	return p
+}
+
+// blockParam returns the block the call is evaluated at. Calls to methods
+// which take an optional block parameter default to "latest". It returns
+// nil for methods without a block parameter.
+func (c *JSONRPCRequest) blockParam() *blockRef {
+	i, ok := blockParamIndex[c.Method]
+	if !ok {
+		return nil
+	}
+	p := c.params()
+	if len(p) <= i {
+		return &blockRef{Tag: "latest"}
+	}
+	return parseBlockRef(p[i])
+}
+
+// logsFilter is the filter object of an eth_getLogs call.
+type logsFilter struct {
+	FromBlock string          `json:"fromBlock,omitempty"`
+	ToBlock   string          `json:"toBlock,omitempty"`
+	BlockHash string          `json:"blockHash,omitempty"`
+	Address   json.RawMessage `json:"address,omitempty"`
+	Topics    json.RawMessage `json:"topics,omitempty"`
+}
+
+func (c *JSONRPCRequest) logsFilter() *logsFilter {
+	if c.Method != "eth_getLogs" {
+		return nil
+	}
+	p := c.params()
+	if len(p) == 0 {
+		return nil
+	}
+	f := &logsFilter{}
+	if err := json.Unmarshal(p[0], f); err != nil {
+		return nil
+	}
+	return f
+}
+
+// pinned reports whether the call is evaluated at a fixed block, by number
+// or hash, so its answer does not change as the chain grows. Responses at
+// blocks which are later replaced are invalidated by the reorg index.
+func (c *JSONRPCRequest) pinned() bool {
+	if f := c.logsFilter(); f != nil {
+		if f.BlockHash != "" {
+			return true
+		}
+		_, ok := parseHexUint(f.ToBlock)
+		return ok
+	}
+	b := c.blockParam()
+	return b != nil && b.Tag == ""
+}
+
+// settledBlock reports whether block n is below head by at least the reorg
+// depth, so it exists and is not expected to be replaced.
+func settledBlock(n uint64, head uint64) bool {
+	return n <= head && head-n >= reorgTrackDepth
+}
+
+// settled reports whether the call is evaluated at a block hash, or at a
+// block number settled below head. Null and error answers at blocks above
+// head, or within the reorg depth of it, change once those blocks are
+// produced or replaced, so only settled calls keep negative entries long.
+func (c *JSONRPCRequest) settled(head uint64) bool {
+	if f := c.logsFilter(); f != nil {
+		if f.BlockHash != "" {
+			return true
+		}
+		n, ok := parseHexUint(f.ToBlock)
+		return ok && settledBlock(n, head)
+	}
+	b := c.blockParam()
+	if b == nil || b.Tag != "" {
+		return false
+	}
+	return b.Hash != "" || settledBlock(b.Number, head)
+}
+
+// resolveBlock returns the block number a reference resolves to with the
+// chain at head. Hash references and unknown tags do not resolve.
+func resolveBlock(ref string, head uint64) (uint64, bool) {
+	if ref == "" {
+		return head, true
+	}
+	if n, ok := parseHexUint(ref); ok {
+		return n, true
+	}
+	switch ref {
+	case "latest", "pending", "safe", "finalized":
+		return head, true
+	case "earliest":
+		return 0, true
+	}
+	return 0, false
+}
+
+// blockHeights returns the block heights the response to the call depends
+// on, given the chain head when it was answered and the call's result. A
+// reorg at any of these heights invalidates the response.
+func (c *JSONRPCRequest) blockHeights(result json.RawMessage, head uint64) []uint64 {
+	if f := c.logsFilter(); f != nil {
+		if f.BlockHash != "" {
+			return nil
+		}
+		// a reorg can only replace blocks near the head, so a range is
+		// affected exactly when its upper bound is
+		to, ok := resolveBlock(f.ToBlock, head)
+		if !ok {
+			return nil
+		}
+		if to > head {
+			to = head
+		}
+		return []uint64{to}
+	}
+	if b := c.blockParam(); b != nil {
+		if b.Hash != "" || b.Tag == "earliest" {
+			return nil
+		}
+		n, ok := resolveBlock(b.Tag, head)
+		if b.Tag == "" {
+			n, ok = b.Number, true
+		}
+		if !ok {
+			return nil
+		}
+		return []uint64{n}
+	}
+	// transactions and receipts looked up by hash carry their block
+	var r struct {
+		BlockNumber string `json:"blockNumber"`
+	}
+	if err := json.Unmarshal(result, &r); err == nil {
+		if n, ok := parseHexUint(r.BlockNumber); ok {
+			return []uint64{n}
+		}
+	}
+	return nil
+}
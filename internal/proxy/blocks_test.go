@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBlockHeights(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    string
+		result string
+		want   []uint64
+	}{
+		{
+			name: "block by number",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x64",false]}`,
+			want: []uint64{100},
+		},
+		{
+			name: "latest resolves to the head",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0xab","latest"]}`,
+			want: []uint64{1000},
+		},
+		{
+			name: "block hash",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xab"},{"blockHash":"0xcd"}]}`,
+		},
+		{
+			name: "earliest",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["earliest",false]}`,
+		},
+		{
+			name: "logs range depends on its upper bound",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1","toBlock":"0x3e0"}]}`,
+			want: []uint64{992},
+		},
+		{
+			name: "logs range past the head",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1","toBlock":"0x1000"}]}`,
+			want: []uint64{1000},
+		},
+		{
+			name: "logs by block hash",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"blockHash":"0xcd"}]}`,
+		},
+		{
+			name:   "receipt carries its block",
+			req:    `{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionReceipt","params":["0xab"]}`,
+			result: `{"blockNumber":"0x3e7","status":"0x1"}`,
+			want:   []uint64{999},
+		},
+		{
+			name:   "pending transaction",
+			req:    `{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionByHash","params":["0xab"]}`,
+			result: `{"blockNumber":null}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mustParseRPCRequest(t, tt.req)
+			got := r.Calls[0].blockHeights(json.RawMessage(tt.result), 1000)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("blockHeights() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinnedAndSettled(t *testing.T) {
+	defer func(depth uint64) { reorgTrackDepth = depth }(reorgTrackDepth)
+	reorgTrackDepth = 64
+	tests := []struct {
+		name        string
+		req         string
+		wantPinned  bool
+		wantSettled bool
+	}{
+		{
+			name:        "settled block number",
+			req:         `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x64",false]}`,
+			wantPinned:  true,
+			wantSettled: true,
+		},
+		{
+			name:       "block number within the reorg depth",
+			req:        `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x3c0",false]}`,
+			wantPinned: true,
+		},
+		{
+			name:       "block number above the head",
+			req:        `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x3e9",false]}`,
+			wantPinned: true,
+		},
+		{
+			name:        "block hash",
+			req:         `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xab"},{"blockHash":"0xcd"}]}`,
+			wantPinned:  true,
+			wantSettled: true,
+		},
+		{
+			name: "latest",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xab"},"latest"]}`,
+		},
+		{
+			name: "finalized tag",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["finalized",false]}`,
+		},
+		{
+			name:        "logs to a settled block",
+			req:         `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1","toBlock":"0x64"}]}`,
+			wantPinned:  true,
+			wantSettled: true,
+		},
+		{
+			name:       "logs to a recent block",
+			req:        `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1","toBlock":"0x3e8"}]}`,
+			wantPinned: true,
+		},
+		{
+			name: "logs to latest",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1","toBlock":"latest"}]}`,
+		},
+		{
+			name:        "logs by block hash",
+			req:         `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"blockHash":"0xcd"}]}`,
+			wantPinned:  true,
+			wantSettled: true,
+		},
+		{
+			name: "no block parameter",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionReceipt","params":["0xab"]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mustParseRPCRequest(t, tt.req).Calls[0]
+			if got := c.pinned(); got != tt.wantPinned {
+				t.Errorf("pinned() = %v, want %v", got, tt.wantPinned)
+			}
+			if got := c.settled(1000); got != tt.wantSettled {
+				t.Errorf("settled() = %v, want %v", got, tt.wantSettled)
+			}
+		})
+	}
+}
@@ -2,51 +2,101 @@ package proxy
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/robertlestak/ethlb/internal/auth"
 	"github.com/robertlestak/ethlb/internal/metrics"
+	"github.com/robertlestak/ethlb/internal/ratelimit"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	Chains []*chain
+	// workers are the background goroutines stopped by Close
+	workers sync.WaitGroup
+	// runCtx is done once ethlb shuts down, stopping background work
+	// started by requests such as stale cache refreshes
+	runCtx = context.Background()
 )
 
 type ChainEndpoint struct {
-	Endpoint      string            `json:"endpoint"`
-	Enabled       bool              `json:"enabled"`
-	Failover      bool              `json:"failover"`
-	ReadOnly      bool              `json:"readOnly"`
-	CooldownUntil time.Time         `json:"cooldownUntil"`
-	BlockHead     uint64            `json:"blockHead"`
-	Client        *ethclient.Client `json:"-"`
+	Endpoint      string    `json:"endpoint"`
+	Enabled       bool      `json:"enabled"`
+	Failover      bool      `json:"failover"`
+	ReadOnly      bool      `json:"readOnly"`
+	CooldownUntil time.Time `json:"cooldownUntil"`
+	BlockHead     uint64    `json:"blockHead"`
+	// RateLimit and MaxConcurrent cap the requests sent to the endpoint,
+	// such as to stay within a provider's quota. Requests spill over to
+	// other endpoints while it is at capacity.
+	RateLimit     *ratelimit.Rate    `json:"rateLimit,omitempty"`
+	MaxConcurrent int                `json:"maxConcurrent,omitempty"`
+	TLS           *endpointTLSConfig `json:"tls,omitempty"`
+	// Auth is the credentials sent with every request to the endpoint
+	Auth      *upstreamAuth     `json:"auth,omitempty"`
+	Client    *ethclient.Client `json:"-"`
+	rpcClient *rpc.Client
+	tlsConfig *tls.Config
+	tlsSum    [sha256.Size]byte
+	// transport is kept across config reloads while the endpoint's tls
+	// settings and credentials are unchanged, conns is its connection pool
+	transport http.RoundTripper
+	conns     *http.Transport
+	// lastProbe and probeErr are the time and error of the last block head
+	// probe
+	lastProbe time.Time
+	probeErr  error
+	// inflight and latency are shared with the endpoint's replacement on
+	// config reloads
+	inflight *int32
+	latency  *latencyTracker
+	// mu is the chain's lock, which guards Enabled, CooldownUntil,
+	// BlockHead and the last probe of its endpoints
+	mu *sync.Mutex
 }
 
 type chain struct {
 	Name      string           `json:"name"`
 	Endpoints []*ChainEndpoint `json:"endpoints"`
-	next      uint32
+	CacheWarm *cacheWarmConfig `json:"cacheWarm,omitempty"`
+	RateLimit *ratelimit.Rate  `json:"rateLimit,omitempty"`
+	// Methods is the chain's method policy, applied after the default policy
+	Methods *auth.MethodPolicy `json:"methods,omitempty"`
+	next    uint32
+	warm    warmState
+	// mu guards the routing state of the endpoints, which is updated by
+	// probes, failed requests and other replicas concurrently
+	mu sync.Mutex
 }
 
 type Chain interface {
 	EnabledEndpoints() []*ChainEndpoint
-	NextEndpoint() (string, error)
+	NextEndpoint(readOnly bool) (*ChainEndpoint, error)
 }
 
 func CreateChainClients() error {
+	return createChainClients(Chains)
+}
+
+func createChainClients(chains []*chain) error {
 	l := log.WithFields(log.Fields{"func": "CreateChainClients"})
 	l.Debug("start")
 	defer l.Debug("end")
 	// loop all chains
-	for _, c := range Chains {
+	for _, c := range chains {
 		// loop each chain endpoints
 		for _, ce := range c.Endpoints {
 			// if endpoint is enabled but client is nil, connect to it
@@ -54,13 +104,14 @@ func CreateChainClients() error {
 				l.WithFields(log.Fields{
 					"endpoint": ce.Endpoint,
 				}).Debug("creating ethclient")
-				client, err := ethclient.Dial(ce.Endpoint)
+				rc, err := ce.dialRPC()
 				if err != nil {
 					l.WithError(err).Error("failed to create ethclient")
 					return err
 				}
 				// set client
-				ce.Client = client
+				ce.rpcClient = rc
+				ce.Client = ethclient.NewClient(rc)
 			}
 		}
 	}
@@ -74,8 +125,26 @@ func UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &chains); err != nil {
 		return err
 	}
+	for _, ch := range chains {
+		for _, ce := range ch.Endpoints {
+			if err := ce.buildTLSConfig(); err != nil {
+				l.WithError(err).WithField("chain", ch.Name).Error("failed to configure endpoint tls")
+				return err
+			}
+			if ce.Auth != nil {
+				if err := ce.Auth.validate(); err != nil {
+					l.WithError(err).WithFields(log.Fields{
+						"chain":    ch.Name,
+						"endpoint": endpointHost(ce.Endpoint),
+					}).Error("failed to resolve endpoint credentials")
+					return err
+				}
+			}
+		}
+	}
 	// loop all current chains
 	for _, c := range Chains {
+		c.mu.Lock()
 		// loop each chain endpoints
 		for _, ce := range c.Endpoints {
 			// loop over all new chains
@@ -86,17 +155,78 @@ func UnmarshalJSON(data []byte) error {
 					if ce.Endpoint == ce2.Endpoint {
 						ce2.Enabled = ce.Enabled
 						ce2.CooldownUntil = ce.CooldownUntil
-						ce2.Client = ce.Client
+						// keep the head until the next probe so ranges
+						// relative to it still resolve after a reload
+						ce2.BlockHead = ce.BlockHead
+						ce2.lastProbe = ce.lastProbe
+						ce2.probeErr = ce.probeErr
+						// reconnect if the endpoint's tls or credentials changed
+						if ce.tlsSum == ce2.tlsSum && ce.Auth.equal(ce2.Auth) {
+							ce2.Client = ce.Client
+							ce2.rpcClient = ce.rpcClient
+							ce2.transport = ce.transport
+							ce2.conns = ce.conns
+						}
+						ce2.inflight = ce.inflight
+						ce2.latency = ce.latency
 					}
 				}
 			}
 		}
+		c.mu.Unlock()
 	}
-	Chains = chains
-	if cerr := CreateChainClients(); cerr != nil {
+	kept := make(map[*http.Transport]bool)
+	for _, ch := range chains {
+		for _, ce := range ch.Endpoints {
+			ce.mu = &ch.mu
+			if ce.inflight == nil {
+				ce.inflight = new(int32)
+			}
+			if ce.latency == nil {
+				ce.latency = &latencyTracker{}
+			}
+			if ce.transport == nil {
+				ce.buildTransport(ch.Name)
+			}
+			kept[ce.conns] = true
+		}
+	}
+	// connect before replacing the current chains, so they are kept if any
+	// endpoint fails
+	if cerr := createChainClients(chains); cerr != nil {
 		l.WithError(cerr).Error("failed to create chain clients")
+		current := make(map[*http.Transport]bool)
+		for _, c := range Chains {
+			for _, ce := range c.Endpoints {
+				current[ce.conns] = true
+			}
+		}
+		for _, ch := range chains {
+			for _, ce := range ch.Endpoints {
+				if !current[ce.conns] {
+					if ce.rpcClient != nil {
+						ce.rpcClient.Close()
+					}
+					ce.closeIdle()
+				}
+			}
+		}
 		return cerr
 	}
+	// release the connections of removed and reconnected endpoints
+	for _, c := range Chains {
+		for _, ce := range c.Endpoints {
+			if !kept[ce.conns] {
+				ce.closeIdle()
+			}
+		}
+	}
+	Chains = chains
+	if healthSyncEnabled {
+		if err := pruneHealthState(); err != nil {
+			l.WithError(err).Error("failed to prune health state")
+		}
+	}
 	l.WithField("chains", len(Chains)).Debug("unmarshalled config")
 	for _, c := range Chains {
 		l.WithFields(log.Fields{
@@ -119,44 +249,91 @@ func LoadConfigFile(filename string) error {
 	return UnmarshalJSON(data)
 }
 
-func HotLoadConfigFile(filename string) error {
+// HotLoadConfigFile loads the config file and reloads it every minute until
+// ctx is done. Background work started by requests stops with ctx as well.
+func HotLoadConfigFile(ctx context.Context, filename string) error {
 	l := log.WithFields(log.Fields{"filename": filename, "action": "HotLoadConfigFile"})
 	l.Debug("hot loading config file")
+	runCtx = ctx
 	if err := LoadConfigFile(filename); err != nil {
 		l.WithError(err).Error("failed to hot load config file")
 		return err
 	}
-	if err := UpdateChainBlockHeads(context.Background()); err != nil {
+	if err := UpdateChainBlockHeads(ctx); err != nil {
 		l.WithError(err).Error("failed to update chain block heads")
 	}
+	workers.Add(1)
 	go func() {
+		defer workers.Done()
 		for {
+			select {
+			case <-ctx.Done():
+				l.Debug("stopped hot loading config file")
+				return
+			case <-time.After(time.Second * 60):
+			}
 			if err := LoadConfigFile(filename); err != nil {
-				l.WithError(err).Fatal("failed to hot load config file")
+				// keep serving with the current config until the next reload
+				l.WithError(err).Error("failed to hot load config file, keeping the current config")
+				continue
 			}
 			l.Debug("hot loaded config file")
-			time.Sleep(time.Second * 60)
 		}
 	}()
 	return nil
 }
 
+// Close waits for the config reload to stop, then closes the endpoints'
+// clients and upstream connections.
+func Close() {
+	l := log.WithFields(log.Fields{"action": "Close"})
+	l.Debug("closing chain clients")
+	workers.Wait()
+	for _, c := range Chains {
+		for _, ce := range c.Endpoints {
+			if ce.rpcClient != nil {
+				ce.rpcClient.Close()
+			}
+			ce.closeIdle()
+		}
+	}
+}
+
 func (c *chain) EnabledEndpoints() []*ChainEndpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enabledEndpoints()
+}
+
+// enabledEndpoints is EnabledEndpoints with c.mu held.
+func (c *chain) enabledEndpoints() []*ChainEndpoint {
 	l := log.WithFields(log.Fields{
 		"chain":  c.Name,
 		"action": "EnabledEndpoints",
 	})
 	l.Debug("getting enabled endpoints")
-	var enabled []*ChainEndpoint
-	var failover []*ChainEndpoint
 	for _, e := range c.Endpoints {
 		// if endpoint is disabled due to cooldown, but the cooldown is over, re-enable the endpoint
 		if !e.Enabled && time.Now().After(e.CooldownUntil) {
 			e.Enabled = true
 			e.CooldownUntil = time.Time{}
 		}
+	}
+	return c.routable(time.Now())
+}
+
+// routable returns the endpoints requests would be routed to at now,
+// without re-enabling endpoints whose cooldown is over. c.mu must be held.
+func (c *chain) routable(now time.Time) []*ChainEndpoint {
+	l := log.WithFields(log.Fields{
+		"chain":  c.Name,
+		"action": "routable",
+	})
+	var enabled []*ChainEndpoint
+	var failover []*ChainEndpoint
+	for _, e := range c.Endpoints {
 		// if endpoint is enabled, add to enabled list
-		if e.Enabled && e.Client != nil {
+		if (e.Enabled || now.After(e.CooldownUntil)) && e.Client != nil {
 			enabled = append(enabled, e)
 		}
 		// if endpoint is enabled and failover is enabled, add to failover list
@@ -171,6 +348,9 @@ func (c *chain) EnabledEndpoints() []*ChainEndpoint {
 	} else if len(enabled) == 0 && len(failover) == 0 && len(c.Endpoints) == 1 {
 		l.WithField("failover", len(failover)).Debug("using single endpoint")
 		return c.Endpoints
+	} else if len(enabled) == 0 {
+		l.Debug("no enabled endpoints")
+		return nil
 	}
 	sort.Slice(enabled, func(i, j int) bool {
 		return enabled[i].BlockHead > enabled[j].BlockHead
@@ -208,17 +388,23 @@ func CooldownEndpoint(chain string, e string) error {
 	for _, c := range Chains {
 		if c.Name == chain {
 			for _, ce := range c.Endpoints {
+				if ce.Endpoint != e {
+					continue
+				}
+				c.mu.Lock()
 				// only cool down if there are other enabled endpoints
-				if ce.Endpoint == e && len(c.EnabledEndpoints()) > 1 {
-					ce.Enabled = false
-					ce.CooldownUntil = time.Now().Add(cdur)
-					metrics.Cooldowns.WithLabelValues(e).Set(float64(ce.CooldownUntil.Unix()))
-					l.Debug("cooldown endpoint")
-					return nil
-				} else if ce.Endpoint == e && len(c.EnabledEndpoints()) == 1 {
+				if len(c.enabledEndpoints()) <= 1 {
+					c.mu.Unlock()
 					l.Debug("not cooling down endpoint")
 					return nil
 				}
+				ce.Enabled = false
+				ce.CooldownUntil = time.Now().Add(cdur)
+				metrics.Cooldowns.WithLabelValues(e).Set(float64(ce.CooldownUntil.Unix()))
+				c.mu.Unlock()
+				publishEndpointState(c.Name, ce)
+				l.Debug("cooldown endpoint")
+				return nil
 			}
 		}
 	}
@@ -226,22 +412,22 @@ func CooldownEndpoint(chain string, e string) error {
 	return errors.New("no such endpoint")
 }
 
-func (c *chain) NextEndpoint(readOnly bool) (string, error) {
+// candidates returns the endpoints a request may be sent to, preferring
+// read-only endpoints for read-only requests.
+func (c *chain) candidates(readOnly bool) ([]*ChainEndpoint, error) {
 	l := log.WithFields(log.Fields{
 		"chain":    c.Name,
-		"action":   "NextEndpoint",
+		"action":   "candidates",
 		"readOnly": readOnly,
 	})
-	l.Debug("getting next endpoint")
-	var es string
 	if len(c.Endpoints) == 0 {
 		l.Error("no endpoints")
-		return es, errors.New("no endpoints")
+		return nil, errors.New("no endpoints")
 	}
 	enabled := c.EnabledEndpoints()
 	if len(enabled) == 0 {
 		l.Error("no enabled endpoints")
-		return es, errors.New("no enabled endpoints")
+		return nil, errors.New("no enabled endpoints")
 	}
 	if readOnly {
 		ts := enabled
@@ -256,17 +442,34 @@ func (c *chain) NextEndpoint(readOnly bool) (string, error) {
 			enabled = ts
 		}
 	}
+	return enabled, nil
+}
+
+// NextEndpoint selects the endpoint for a request round robin. Capacity is
+// reserved per upstream attempt by acquireEndpoint, which spills over to
+// other endpoints while this one is at capacity.
+func (c *chain) NextEndpoint(readOnly bool) (*ChainEndpoint, error) {
+	l := log.WithFields(log.Fields{
+		"chain":    c.Name,
+		"action":   "NextEndpoint",
+		"readOnly": readOnly,
+	})
+	l.Debug("getting next endpoint")
+	enabled, err := c.candidates(readOnly)
+	if err != nil {
+		return nil, err
+	}
 	n := atomic.AddUint32(&c.next, 1)
-	ne := enabled[(int(n)-1)%len(enabled)].Endpoint
+	ne := enabled[(int(n)-1)%len(enabled)]
 	l.WithFields(log.Fields{
 		"next":     n,
 		"len":      len(enabled),
-		"endpoint": ne,
+		"endpoint": ne.Endpoint,
 	}).Debug("next endpoint")
 	return ne, nil
 }
 
-func GetEndpoint(chainName string, readOnly bool) (string, error) {
+func GetEndpoint(chainName string, readOnly bool) (*ChainEndpoint, error) {
 	l := log.WithFields(log.Fields{
 		"chain":    chainName,
 		"action":   "GetEndpoint",
@@ -278,13 +481,33 @@ func GetEndpoint(chainName string, readOnly bool) (string, error) {
 			ne, nerr := c.NextEndpoint(readOnly)
 			if nerr != nil {
 				l.WithError(nerr).Error("failed to get next endpoint")
-				return "", nerr
+				return nil, nerr
 			}
 			return ne, nil
 		}
 	}
 	l.Error("failed to get endpoint")
-	return "", errors.New("no such chain")
+	return nil, errors.New("no such chain")
+}
+
+// head returns the highest block head of the chain's enabled endpoints.
+func (c *chain) head() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var head uint64
+	for _, e := range c.Endpoints {
+		if e.Enabled && e.BlockHead > head {
+			head = e.BlockHead
+		}
+	}
+	return head
+}
+
+// blockHead returns the endpoint's last known block head.
+func (e *ChainEndpoint) blockHead() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.BlockHead
 }
 
 func (c *chain) UpdateEndpointBlockHead(ctx context.Context) error {
@@ -295,16 +518,29 @@ func (c *chain) UpdateEndpointBlockHead(ctx context.Context) error {
 	l.Debug("start")
 	for _, e := range c.Endpoints {
 		l = l.WithField("endpoint", e.Endpoint)
+		c.mu.Lock()
 		if e.Client == nil {
 			l.WithField("endpoint", e.Endpoint).Debug("endpoint with no client")
 			e.Enabled = false
 		}
-		if !e.Enabled {
+		enabled := e.Enabled
+		c.mu.Unlock()
+		if !enabled {
 			l.WithField("endpoint", e.Endpoint).Debug("skipping disabled endpoint")
 			metrics.EndpointEnabled.WithLabelValues(c.Name, e.Endpoint).Set(0)
 			continue
 		}
 		bn, berr := e.Client.BlockNumber(ctx)
+		if berr != nil && ctx.Err() != nil {
+			// probes interrupted by shutdown say nothing about the endpoint,
+			// and must not cool it down on other replicas
+			l.WithError(berr).Debug("probe canceled")
+			return ctx.Err()
+		}
+		c.mu.Lock()
+		e.lastProbe = time.Now()
+		e.probeErr = berr
+		c.mu.Unlock()
 		if berr != nil {
 			l.WithError(berr).Error("failed to get block number")
 			// if we can't get the block number, we can't update the block head
@@ -315,25 +551,39 @@ func (c *chain) UpdateEndpointBlockHead(ctx context.Context) error {
 			return berr
 		}
 		l = l.WithField("block", bn)
-		if e.BlockHead != bn {
-			e.BlockHead = bn
+		c.mu.Lock()
+		changed := e.BlockHead != bn
+		e.BlockHead = bn
+		cooldownUntil := e.CooldownUntil
+		enabled = e.Enabled
+		c.mu.Unlock()
+		if changed {
+			publishEndpointState(c.Name, e)
 			l.Debug("updated endpoint block head")
 		} else {
 			l.Debug("endpoint block head unchanged")
 		}
-		metrics.EndpointBlockHead.WithLabelValues(c.Name, e.Endpoint).Set(float64(e.BlockHead))
+		metrics.EndpointBlockHead.WithLabelValues(c.Name, e.Endpoint).Set(float64(bn))
 		// if cooldown is zero, zero out metric
-		if !e.CooldownUntil.IsZero() {
-			metrics.Cooldowns.WithLabelValues(e.Endpoint).Set(float64(e.CooldownUntil.Unix()))
-		} else if time.Until(e.CooldownUntil) <= 0 {
+		if !cooldownUntil.IsZero() {
+			metrics.Cooldowns.WithLabelValues(e.Endpoint).Set(float64(cooldownUntil.Unix()))
+		} else if time.Until(cooldownUntil) <= 0 {
 			metrics.Cooldowns.WithLabelValues(e.Endpoint).Set(0)
 		}
-		if e.Enabled {
+		if enabled {
 			metrics.EndpointEnabled.WithLabelValues(c.Name, e.Endpoint).Set(1)
 		} else {
 			metrics.EndpointEnabled.WithLabelValues(c.Name, e.Endpoint).Set(0)
 		}
 	}
+	if err := c.checkReorg(ctx); err != nil {
+		l.WithError(err).Error("failed to check for reorg")
+	}
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		c.warmCache(ctx)
+	}()
 	l.Debug("end")
 	return nil
 }
@@ -394,7 +644,7 @@ func UpdateChainBlockHeads(ctx context.Context) error {
 	return nil
 }
 
-func HealthProber() {
+func HealthProber(ctx context.Context) {
 	l := log.WithFields(log.Fields{
 		"action": "HealthProber",
 	})
@@ -409,9 +659,12 @@ func HealthProber() {
 			return
 		}
 	}
-	ctx := context.Background()
 	for {
-		time.Sleep(probeInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(probeInterval):
+		}
 		if err := UpdateChainBlockHeads(ctx); err != nil {
 			l.WithError(err).Error("failed to update chain block heads")
 		}
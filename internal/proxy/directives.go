@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// cacheDirectiveName is the header and query parameter clients set cache
+	// directives with
+	cacheDirectiveName = "ethlbcache"
+)
+
+// cacheDirectives are a client's per-request cache controls.
+type cacheDirectives struct {
+	// noRead skips the cache lookup, the response is still cached
+	noRead bool
+	// noStore does not cache the response
+	noStore bool
+	// maxAge only accepts cached responses at most this old when set
+	maxAge    time.Duration
+	hasMaxAge bool
+}
+
+// parseCacheDirectives reads comma separated directives from the ethlbcache
+// header and query parameter:
+//
+//	no-read    fetch from upstream, caching the response
+//	refresh    same as no-read, replacing the cached response
+//	no-store   do not cache the response
+//	max-age=N  only serve cached responses at most N seconds old
+//
+// "false" is kept as an alias of no-read. Unknown directives are ignored.
+func parseCacheDirectives(r *http.Request) cacheDirectives {
+	var d cacheDirectives
+	vals := append(r.Header.Values(cacheDirectiveName), r.URL.Query()[cacheDirectiveName]...)
+	for _, v := range vals {
+		for _, p := range strings.Split(v, ",") {
+			p = strings.ToLower(strings.TrimSpace(p))
+			switch {
+			case p == "no-read" || p == "refresh" || p == "false":
+				d.noRead = true
+			case p == "no-store":
+				d.noStore = true
+			case strings.HasPrefix(p, "max-age="):
+				s, err := strconv.ParseUint(strings.TrimPrefix(p, "max-age="), 10, 32)
+				if err != nil {
+					continue
+				}
+				d.maxAge = time.Duration(s) * time.Second
+				d.hasMaxAge = true
+			}
+		}
+	}
+	return d
+}
+
+// stripCacheDirectives removes the ethlbcache query parameter so it is not
+// sent upstream.
+func stripCacheDirectives(u *url.URL) {
+	q := u.Query()
+	if _, ok := q[cacheDirectiveName]; !ok {
+		return
+	}
+	q.Del(cacheDirectiveName)
+	u.RawQuery = q.Encode()
+}
+
+// endpointHost returns the host of an endpoint URL, keeping credentials and
+// paths, which may hold API keys, out of response headers.
+func endpointHost(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
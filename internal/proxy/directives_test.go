@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseCacheDirectives(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		query  string
+		want   cacheDirectives
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:   "no-read",
+			header: []string{"no-read"},
+			want:   cacheDirectives{noRead: true},
+		},
+		{
+			name:   "refresh",
+			header: []string{"refresh"},
+			want:   cacheDirectives{noRead: true},
+		},
+		{
+			name:   "false alias",
+			header: []string{"false"},
+			want:   cacheDirectives{noRead: true},
+		},
+		{
+			name:   "no-store",
+			header: []string{"no-store"},
+			want:   cacheDirectives{noStore: true},
+		},
+		{
+			name:   "max-age",
+			header: []string{"max-age=30"},
+			want:   cacheDirectives{maxAge: 30 * time.Second, hasMaxAge: true},
+		},
+		{
+			name:   "max-age zero",
+			header: []string{"max-age=0"},
+			want:   cacheDirectives{hasMaxAge: true},
+		},
+		{
+			name:   "invalid max-age is ignored",
+			header: []string{"max-age=-1", "max-age=soon"},
+		},
+		{
+			name:   "comma separated with spaces and case",
+			header: []string{" No-Read , NO-STORE,max-age=5 "},
+			want:   cacheDirectives{noRead: true, noStore: true, maxAge: 5 * time.Second, hasMaxAge: true},
+		},
+		{
+			name:   "repeated headers",
+			header: []string{"no-read", "no-store"},
+			want:   cacheDirectives{noRead: true, noStore: true},
+		},
+		{
+			name:  "query",
+			query: "?ethlbcache=no-store,max-age=10",
+			want:  cacheDirectives{noStore: true, maxAge: 10 * time.Second, hasMaxAge: true},
+		},
+		{
+			name:   "header and query",
+			header: []string{"no-read"},
+			query:  "?ethlbcache=no-store",
+			want:   cacheDirectives{noRead: true, noStore: true},
+		},
+		{
+			name:   "unknown directives are ignored",
+			header: []string{"no-cache,private"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/ethereum"+tt.query, nil)
+			for _, h := range tt.header {
+				r.Header.Add(cacheDirectiveName, h)
+			}
+			if got := parseCacheDirectives(r); got != tt.want {
+				t.Errorf("parseCacheDirectives() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// maxRequestBodyBytes caps the size of request bodies
+	maxRequestBodyBytes int64 = 10 << 20
+	// maxBatchSize caps the number of calls in a batch
+	maxBatchSize = 1000
+	// maxLogsBlockRange, maxLogsAddresses and maxLogsTopics cap eth_getLogs
+	// filters. 0 disables a limit.
+	maxLogsBlockRange uint64
+	maxLogsAddresses  int
+	maxLogsTopics     int
+
+	errRequestTooLarge = errors.New("request body too large")
+)
+
+func ConfigRequestLimits() error {
+	l := log.WithFields(log.Fields{
+		"action": "ConfigRequestLimits",
+	})
+	l.Debug("start")
+	var err error
+	if os.Getenv("MAX_REQUEST_BODY_BYTES") != "" {
+		maxRequestBodyBytes, err = strconv.ParseInt(os.Getenv("MAX_REQUEST_BODY_BYTES"), 10, 64)
+		if err != nil {
+			l.WithError(err).Error("failed to parse MAX_REQUEST_BODY_BYTES")
+			return err
+		}
+	}
+	if os.Getenv("MAX_BATCH_SIZE") != "" {
+		maxBatchSize, err = strconv.Atoi(os.Getenv("MAX_BATCH_SIZE"))
+		if err != nil {
+			l.WithError(err).Error("failed to parse MAX_BATCH_SIZE")
+			return err
+		}
+	}
+	if os.Getenv("MAX_LOGS_BLOCK_RANGE") != "" {
+		maxLogsBlockRange, err = strconv.ParseUint(os.Getenv("MAX_LOGS_BLOCK_RANGE"), 10, 64)
+		if err != nil {
+			l.WithError(err).Error("failed to parse MAX_LOGS_BLOCK_RANGE")
+			return err
+		}
+	}
+	if os.Getenv("MAX_LOGS_ADDRESSES") != "" {
+		maxLogsAddresses, err = strconv.Atoi(os.Getenv("MAX_LOGS_ADDRESSES"))
+		if err != nil {
+			l.WithError(err).Error("failed to parse MAX_LOGS_ADDRESSES")
+			return err
+		}
+	}
+	if os.Getenv("MAX_LOGS_TOPICS") != "" {
+		maxLogsTopics, err = strconv.Atoi(os.Getenv("MAX_LOGS_TOPICS"))
+		if err != nil {
+			l.WithError(err).Error("failed to parse MAX_LOGS_TOPICS")
+			return err
+		}
+	}
+	return nil
+}
+
+// addressCount returns the number of addresses the filter matches on.
+func (f *logsFilter) addressCount() int {
+	var many []string
+	if err := json.Unmarshal(f.Address, &many); err == nil {
+		return len(many)
+	}
+	var one string
+	if err := json.Unmarshal(f.Address, &one); err == nil && one != "" {
+		return 1
+	}
+	return 0
+}
+
+// topicCount returns the number of topics the filter matches on, counting
+// each alternative of a position.
+func (f *logsFilter) topicCount() int {
+	var positions []json.RawMessage
+	if err := json.Unmarshal(f.Topics, &positions); err != nil {
+		return 0
+	}
+	var n int
+	for _, p := range positions {
+		var alts []string
+		if err := json.Unmarshal(p, &alts); err == nil {
+			n += len(alts)
+			continue
+		}
+		var one string
+		if err := json.Unmarshal(p, &one); err == nil && one != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// blockRange returns the number of blocks the filter spans with the chain
+// at head, or false if it is not a range or can't be resolved.
+func (f *logsFilter) blockRange(head uint64) (uint64, bool) {
+	if f.BlockHash != "" {
+		return 0, false
+	}
+	from, fok := resolveBlock(f.FromBlock, head)
+	to, tok := resolveBlock(f.ToBlock, head)
+	if !fok || !tok || to < from {
+		return 0, false
+	}
+	return to - from + 1, true
+}
+
+// checkLogsFilter returns an error describing the first limit the call's
+// eth_getLogs filter exceeds.
+func (c *JSONRPCRequest) checkLogsFilter(head uint64) error {
+	f := c.logsFilter()
+	if f == nil {
+		return nil
+	}
+	if maxLogsBlockRange > 0 {
+		if n, ok := f.blockRange(head); ok && n > maxLogsBlockRange {
+			return fmt.Errorf("eth_getLogs block range of %d blocks exceeds the limit of %d blocks", n, maxLogsBlockRange)
+		}
+	}
+	if n := f.addressCount(); maxLogsAddresses > 0 && n > maxLogsAddresses {
+		return fmt.Errorf("eth_getLogs filter with %d addresses exceeds the limit of %d addresses", n, maxLogsAddresses)
+	}
+	if n := f.topicCount(); maxLogsTopics > 0 && n > maxLogsTopics {
+		return fmt.Errorf("eth_getLogs filter with %d topics exceeds the limit of %d topics", n, maxLogsTopics)
+	}
+	return nil
+}
+
+// checkRequestLimits rejects requests which are too large, or batches and
+// eth_getLogs filters exceeding the configured limits, before they reach an
+// upstream. It writes an error response and returns false if the request is
+// rejected.
+func checkRequestLimits(w http.ResponseWriter, chainName string, rr *rpcRequest, perr error) bool {
+	l := log.WithFields(log.Fields{
+		"chain":  chainName,
+		"action": "checkRequestLimits",
+	})
+	if perr == errRequestTooLarge {
+		l.Debug("request body too large")
+		writeRPCError(w, http.StatusRequestEntityTooLarge, rpcErrInvalidRequest,
+			fmt.Sprintf("request body exceeds the limit of %d bytes", maxRequestBodyBytes))
+		return false
+	}
+	if rr == nil {
+		return true
+	}
+	if rr.Batch && maxBatchSize > 0 && len(rr.Calls) > maxBatchSize {
+		l.WithField("size", len(rr.Calls)).Debug("batch too large")
+		writeRPCError(w, http.StatusBadRequest, rpcErrInvalidRequest,
+			fmt.Sprintf("batch of %d calls exceeds the limit of %d calls", len(rr.Calls), maxBatchSize))
+		return false
+	}
+	var head uint64
+	for _, c := range Chains {
+		if c.Name == chainName {
+			head = c.head()
+		}
+	}
+	for _, c := range rr.Calls {
+		if err := c.checkLogsFilter(head); err != nil {
+			l.WithError(err).Debug("logs filter exceeds limits")
+			writeRPCError(w, http.StatusBadRequest, rpcErrInvalidParams, err.Error())
+			return false
+		}
+	}
+	return true
+}
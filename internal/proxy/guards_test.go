@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckRequestLimits(t *testing.T) {
+	defer func(body int64, batch int, blocks uint64, addresses, topics int) {
+		maxRequestBodyBytes, maxBatchSize, maxLogsBlockRange, maxLogsAddresses, maxLogsTopics = body, batch, blocks, addresses, topics
+	}(maxRequestBodyBytes, maxBatchSize, maxLogsBlockRange, maxLogsAddresses, maxLogsTopics)
+	maxRequestBodyBytes = 512
+	maxBatchSize = 2
+	maxLogsBlockRange = 100
+	maxLogsAddresses = 2
+	maxLogsTopics = 3
+	prev := Chains
+	defer func() { Chains = prev }()
+	Chains = []*chain{{
+		Name:      "ethereum",
+		Endpoints: []*ChainEndpoint{{Enabled: true, BlockHead: 1000}},
+	}}
+	logs := func(filter string) string {
+		return `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[` + filter + `]}`
+	}
+	call := `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{
+			name: "call",
+			body: call,
+		},
+		{
+			name:     "body too large",
+			body:     `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":["` + strings.Repeat("0", 512) + `"]}`,
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "batch at the limit",
+			body: "[" + call + "," + call + "]",
+		},
+		{
+			name:     "batch too large",
+			body:     "[" + call + "," + call + "," + call + "]",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "logs range at the limit",
+			body: logs(`{"fromBlock":"0x1","toBlock":"0x64"}`),
+		},
+		{
+			name:     "logs range too large",
+			body:     logs(`{"fromBlock":"0x1","toBlock":"0x65"}`),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "logs range resolved against the head",
+			body:     logs(`{"fromBlock":"0x1","toBlock":"latest"}`),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "logs range near the head",
+			body: logs(`{"fromBlock":"0x3e8","toBlock":"latest"}`),
+		},
+		{
+			name: "logs by block hash",
+			body: logs(`{"blockHash":"0xab"}`),
+		},
+		{
+			name:     "too many addresses",
+			body:     logs(`{"blockHash":"0xab","address":["0x1","0x2","0x3"]}`),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "one address",
+			body: logs(`{"blockHash":"0xab","address":"0x1"}`),
+		},
+		{
+			name:     "too many topics",
+			body:     logs(`{"blockHash":"0xab","topics":["0x1",null,["0x2","0x3","0x4"]]}`),
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "topics at the limit",
+			body: logs(`{"blockHash":"0xab","topics":["0x1",null,["0x2","0x3"]]}`),
+		},
+		{
+			name:     "logs limits apply within batches",
+			body:     "[" + call + "," + logs(`{"fromBlock":"0x1","toBlock":"0x3e8"}`) + "]",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "invalid body is left to the method policy",
+			body: "not json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/ethereum", bytes.NewBufferString(tt.body))
+			rr, perr := readRPCRequest(r)
+			w := httptest.NewRecorder()
+			ok := checkRequestLimits(w, "ethereum", rr, perr)
+			if ok != (tt.wantCode == 0) {
+				t.Fatalf("checkRequestLimits() = %v, want %v: %s", ok, tt.wantCode == 0, w.Body)
+			}
+			if !ok && w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/cache"
+	"github.com/robertlestak/ethlb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	circuitClosed = "closed"
+	circuitOpen   = "open"
+)
+
+var (
+	healthSyncEnabled bool
+	healthSyncChannel = "ethlb:health"
+	healthStateKey    = "ethlb:health:state"
+	replicaID         string
+)
+
+// healthEvent is the state of a single chain endpoint as observed by one
+// replica. Events are published on healthSyncChannel and the latest event for
+// each endpoint is kept in healthStateKey so new replicas can catch up.
+type healthEvent struct {
+	Origin        string    `json:"origin"`
+	Chain         string    `json:"chain"`
+	Endpoint      string    `json:"endpoint"`
+	Circuit       string    `json:"circuit"`
+	CooldownUntil time.Time `json:"cooldownUntil"`
+	BlockHead     uint64    `json:"blockHead"`
+	Time          time.Time `json:"time"`
+}
+
+// CircuitState reports whether the endpoint is routable ("closed") or
+// cooling down after failures ("open").
+func (ce *ChainEndpoint) CircuitState() string {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	return ce.circuitState()
+}
+
+// circuitState is CircuitState with ce.mu held.
+func (ce *ChainEndpoint) circuitState() string {
+	if !ce.Enabled && time.Now().Before(ce.CooldownUntil) {
+		return circuitOpen
+	}
+	return circuitClosed
+}
+
+func newReplicaID() string {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		h = "ethlb"
+	}
+	return fmt.Sprintf("%s-%d-%x", h, os.Getpid(), rand.New(rand.NewSource(time.Now().UnixNano())).Uint32())
+}
+
+func findChainEndpoint(chainName string, endpoint string) (*chain, *ChainEndpoint) {
+	for _, c := range Chains {
+		if c.Name != chainName {
+			continue
+		}
+		for _, ce := range c.Endpoints {
+			if ce.Endpoint == endpoint {
+				return c, ce
+			}
+		}
+	}
+	return nil, nil
+}
+
+// publishEndpointState shares the current state of ce with the other replicas.
+func publishEndpointState(chainName string, ce *ChainEndpoint) {
+	if !healthSyncEnabled {
+		return
+	}
+	l := log.WithFields(log.Fields{
+		"action":   "publishEndpointState",
+		"chain":    chainName,
+		"endpoint": ce.Endpoint,
+	})
+	l.Debug("start")
+	ce.mu.Lock()
+	ev := healthEvent{
+		Origin:        replicaID,
+		Chain:         chainName,
+		Endpoint:      ce.Endpoint,
+		Circuit:       ce.circuitState(),
+		CooldownUntil: ce.CooldownUntil,
+		BlockHead:     ce.BlockHead,
+		Time:          time.Now(),
+	}
+	ce.mu.Unlock()
+	jd, err := json.Marshal(ev)
+	if err != nil {
+		l.WithError(err).Error("failed to marshal health event")
+		return
+	}
+	if err := cache.SetHashField(healthStateKey, chainName+"|"+ce.Endpoint, string(jd)); err != nil {
+		l.WithError(err).Error("failed to store health state")
+	}
+	if err := cache.Publish(healthSyncChannel, string(jd)); err != nil {
+		l.WithError(err).Error("failed to publish health event")
+	}
+}
+
+// applyHealthEvent merges an endpoint state observed by another replica into
+// the local registry. Cooldowns are adopted if they extend the local one and
+// block heads are only ever moved forward.
+func applyHealthEvent(ev *healthEvent) {
+	l := log.WithFields(log.Fields{
+		"action":   "applyHealthEvent",
+		"origin":   ev.Origin,
+		"chain":    ev.Chain,
+		"endpoint": ev.Endpoint,
+		"circuit":  ev.Circuit,
+	})
+	l.Debug("start")
+	if ev.Origin == replicaID {
+		return
+	}
+	c, ce := findChainEndpoint(ev.Chain, ev.Endpoint)
+	if ce == nil {
+		l.Debug("unknown endpoint")
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ev.Circuit == circuitOpen && time.Now().Before(ev.CooldownUntil) && ev.CooldownUntil.After(ce.CooldownUntil) {
+		// same rule as CooldownEndpoint: never take the last endpoint out of rotation
+		if !ce.Enabled || len(c.enabledEndpoints()) > 1 {
+			ce.Enabled = false
+			ce.CooldownUntil = ev.CooldownUntil
+			metrics.Cooldowns.WithLabelValues(ce.Endpoint).Set(float64(ce.CooldownUntil.Unix()))
+			l.WithField("until", ce.CooldownUntil).Debug("applied remote cooldown")
+		}
+	}
+	if ev.BlockHead > ce.BlockHead {
+		ce.BlockHead = ev.BlockHead
+		metrics.EndpointBlockHead.WithLabelValues(c.Name, ce.Endpoint).Set(float64(ce.BlockHead))
+		l.WithField("block", ce.BlockHead).Debug("applied remote block head")
+	}
+}
+
+func loadHealthState() error {
+	l := log.WithFields(log.Fields{
+		"action": "loadHealthState",
+	})
+	l.Debug("start")
+	state, err := cache.GetHash(healthStateKey)
+	if err != nil {
+		l.WithError(err).Error("failed to load health state")
+		return err
+	}
+	for field, v := range state {
+		ev := &healthEvent{}
+		if err := json.Unmarshal([]byte(v), ev); err != nil {
+			l.WithError(err).WithField("field", field).Error("failed to unmarshal health state")
+			continue
+		}
+		applyHealthEvent(ev)
+	}
+	l.WithField("endpoints", len(state)).Debug("loaded health state")
+	removeStaleHealthState(state)
+	return nil
+}
+
+// pruneHealthState drops the shared state of endpoints which were removed
+// from the config.
+func pruneHealthState() error {
+	l := log.WithFields(log.Fields{
+		"action": "pruneHealthState",
+	})
+	l.Debug("start")
+	state, err := cache.GetHash(healthStateKey)
+	if err != nil {
+		l.WithError(err).Error("failed to load health state")
+		return err
+	}
+	removeStaleHealthState(state)
+	return nil
+}
+
+// removeStaleHealthState deletes the fields of state which are unreadable
+// or belong to endpoints which are not configured.
+func removeStaleHealthState(state map[string]string) {
+	l := log.WithFields(log.Fields{
+		"action": "removeStaleHealthState",
+	})
+	var stale []string
+	for field, v := range state {
+		ev := &healthEvent{}
+		if err := json.Unmarshal([]byte(v), ev); err != nil {
+			stale = append(stale, field)
+			continue
+		}
+		if _, ce := findChainEndpoint(ev.Chain, ev.Endpoint); ce == nil {
+			stale = append(stale, field)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	if err := cache.DelHashFields(healthStateKey, stale...); err != nil {
+		l.WithError(err).Error("failed to remove stale health state")
+		return
+	}
+	l.WithField("endpoints", len(stale)).Debug("removed stale health state")
+}
+
+// StartHealthSync shares endpoint cooldowns, block heads and circuit states
+// between replicas through redis when HEALTH_SYNC_ENABLED is true.
+func StartHealthSync() error {
+	l := log.WithFields(log.Fields{
+		"action": "StartHealthSync",
+	})
+	l.Debug("start")
+	if os.Getenv("HEALTH_SYNC_ENABLED") != "true" {
+		l.Debug("health sync disabled")
+		return nil
+	}
+	if os.Getenv("HEALTH_SYNC_CHANNEL") != "" {
+		healthSyncChannel = os.Getenv("HEALTH_SYNC_CHANNEL")
+		healthStateKey = healthSyncChannel + ":state"
+	}
+	replicaID = newReplicaID()
+	l = l.WithFields(log.Fields{
+		"replica": replicaID,
+		"channel": healthSyncChannel,
+	})
+	ps, err := cache.Subscribe(healthSyncChannel)
+	if err != nil {
+		l.WithError(err).Error("health sync requires a redis cache backend")
+		return err
+	}
+	// wait for the subscription to be confirmed so no events are missed
+	// between loading the snapshot and receiving updates
+	// if redis is unavailable the subscription keeps retrying in the
+	// background and the replica starts with its local view only
+	if _, err := ps.ReceiveTimeout(time.Second * 5); err != nil {
+		l.WithError(err).Warn("failed to confirm health channel subscription")
+	}
+	if err := loadHealthState(); err != nil {
+		l.WithError(err).Error("failed to load health state")
+	}
+	healthSyncEnabled = true
+	go func() {
+		for msg := range ps.Channel() {
+			ev := &healthEvent{}
+			if err := json.Unmarshal([]byte(msg.Payload), ev); err != nil {
+				l.WithError(err).Error("failed to unmarshal health event")
+				continue
+			}
+			applyHealthEvent(ev)
+		}
+	}()
+	l.Info("health sync started")
+	return nil
+}
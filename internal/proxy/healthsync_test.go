@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestApplyHealthEvent(t *testing.T) {
+	a := newFakeNode(t, 100)
+	b := newFakeNode(t, 100)
+	useTestChains(t, `[{"name":"sync","endpoints":[{"endpoint":"`+a.URL+`","enabled":true},{"endpoint":"`+b.URL+`","enabled":true}]}]`)
+	c := Chains[0]
+	ea, eb := c.Endpoints[0], c.Endpoints[1]
+	until := time.Now().Add(time.Minute)
+
+	applyHealthEvent(&healthEvent{Origin: "other", Chain: "sync", Endpoint: a.URL, Circuit: circuitOpen, CooldownUntil: until, BlockHead: 105})
+	if ea.CircuitState() != circuitOpen || ea.blockHead() != 105 {
+		t.Errorf("remote cooldown and head not applied: circuit %s head %d", ea.CircuitState(), ea.blockHead())
+	}
+	// the last routable endpoint is never taken out of rotation
+	applyHealthEvent(&healthEvent{Origin: "other", Chain: "sync", Endpoint: b.URL, Circuit: circuitOpen, CooldownUntil: until})
+	if eb.CircuitState() != circuitClosed {
+		t.Error("remote cooldown took the last endpoint out of rotation")
+	}
+	// heads only move forward
+	applyHealthEvent(&healthEvent{Origin: "other", Chain: "sync", Endpoint: a.URL, BlockHead: 90})
+	if ea.blockHead() != 105 {
+		t.Errorf("head moved back to %d", ea.blockHead())
+	}
+	// events for unknown endpoints and from this replica are ignored
+	applyHealthEvent(&healthEvent{Origin: "other", Chain: "sync", Endpoint: "http://removed", BlockHead: 200})
+	applyHealthEvent(&healthEvent{Origin: replicaID, Chain: "sync", Endpoint: b.URL, BlockHead: 200})
+	if eb.blockHead() == 200 {
+		t.Error("applied an event from this replica")
+	}
+}
+
+func TestApplyHealthEventConcurrently(t *testing.T) {
+	a := newFakeNode(t, 100)
+	b := newFakeNode(t, 100)
+	useTestChains(t, `[{"name":"sync","endpoints":[{"endpoint":"`+a.URL+`","enabled":true},{"endpoint":"`+b.URL+`","enabled":true}]}]`)
+	c := Chains[0]
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				applyHealthEvent(&healthEvent{
+					Origin:        "other",
+					Chain:         "sync",
+					Endpoint:      c.Endpoints[n%2].Endpoint,
+					Circuit:       circuitOpen,
+					CooldownUntil: time.Now().Add(time.Millisecond),
+					BlockHead:     uint64(100 + n),
+				})
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				if _, err := c.NextEndpoint(true); err != nil {
+					t.Error(err)
+					return
+				}
+				c.head()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				if err := CooldownEndpoint("sync", a.URL); err != nil {
+					t.Error(err)
+					return
+				}
+				c.health()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(c.EnabledEndpoints()) == 0 {
+		t.Error("no enabled endpoints left")
+	}
+}
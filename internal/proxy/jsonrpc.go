@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// JSON-RPC error codes returned by ethlb itself
+const (
+	rpcErrInvalidRequest = -32600
+	rpcErrMethodNotFound = -32601
+	rpcErrInvalidParams  = -32602
+	rpcErrInternal       = -32603
+	rpcErrUnauthorized   = -32001
+	rpcErrLimitExceeded  = -32005
+)
+
+var (
+	errEmptyRequest = errors.New("empty request")
+
+	// uncachedMethods send transactions or use state local to a node, such
+	// as filters, and are never cached
+	uncachedMethods = map[string]bool{
+		"eth_sendRawTransaction":          true,
+		"eth_sendTransaction":             true,
+		"eth_sign":                        true,
+		"eth_signTransaction":             true,
+		"eth_signTypedData":               true,
+		"eth_submitWork":                  true,
+		"eth_submitHashrate":              true,
+		"eth_newFilter":                   true,
+		"eth_newBlockFilter":              true,
+		"eth_newPendingTransactionFilter": true,
+		"eth_getFilterChanges":            true,
+		"eth_getFilterLogs":               true,
+		"eth_uninstallFilter":             true,
+		"eth_subscribe":                   true,
+		"eth_unsubscribe":                 true,
+	}
+	uncachedPrefixes = []string{
+		"personal_",
+		"admin_",
+		"miner_",
+	}
+	// knownMethods are used as metric labels as is, other methods are
+	// chosen by clients and counted as "other" to bound label cardinality
+	knownMethods = map[string]bool{
+		"eth_blockNumber":               true,
+		"eth_gasPrice":                  true,
+		"eth_maxPriorityFeePerGas":      true,
+		"eth_feeHistory":                true,
+		"eth_getLogs":                   true,
+		"eth_syncing":                   true,
+		"eth_accounts":                  true,
+		"eth_protocolVersion":           true,
+		"eth_mining":                    true,
+		"eth_hashrate":                  true,
+		"eth_coinbase":                  true,
+		"eth_createAccessList":          true,
+		"net_listening":                 true,
+		"net_peerCount":                 true,
+		"web3_clientVersion":            true,
+		"web3_sha3":                     true,
+		"txpool_content":                true,
+		"txpool_status":                 true,
+		"txpool_inspect":                true,
+		"debug_traceCall":               true,
+		"debug_traceBlockByNumber":      true,
+		"trace_block":                   true,
+		"trace_call":                    true,
+		"trace_filter":                  true,
+		"trace_replayBlockTransactions": true,
+	}
+	// immutableMethods return the same answer every time, or look up data
+	// by hash which only changes with a reorg
+	immutableMethods = map[string]bool{
+		"eth_chainId":                              true,
+		"net_version":                              true,
+		"eth_getBlockByHash":                       true,
+		"eth_getBlockTransactionCountByHash":       true,
+		"eth_getUncleByBlockHashAndIndex":          true,
+		"eth_getUncleCountByBlockHash":             true,
+		"eth_getTransactionByBlockHashAndIndex":    true,
+		"eth_getTransactionByHash":                 true,
+		"eth_getTransactionReceipt":                true,
+		"debug_traceTransaction":                   true,
+		"trace_transaction":                        true,
+		"trace_replayTransaction":                  true,
+		"debug_traceBlockByHash":                   true,
+		"eth_getRawTransactionByHash":              true,
+		"eth_getRawTransactionByBlockHashAndIndex": true,
+	}
+)
+
+// JSONRPCRequest is a single JSON-RPC call sent by a client.
+type JSONRPCRequest struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// rpcRequest is a parsed client request body, either a single call or a batch.
+type rpcRequest struct {
+	Calls []*JSONRPCRequest
+	Batch bool
+}
+
+// rpcEnvelope is a JSON-RPC response with its result kept verbatim, used to
+// rewrite ids without re-encoding results.
+type rpcEnvelope struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   json.RawMessage `json:"error,omitempty"`
+}
+
+func parseRPCRequest(b []byte) (*rpcRequest, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, errEmptyRequest
+	}
+	r := &rpcRequest{}
+	if b[0] == '[' {
+		r.Batch = true
+		if err := json.Unmarshal(b, &r.Calls); err != nil {
+			return nil, err
+		}
+		if len(r.Calls) == 0 {
+			return nil, errors.New("empty batch")
+		}
+	} else {
+		c := &JSONRPCRequest{}
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, err
+		}
+		r.Calls = []*JSONRPCRequest{c}
+	}
+	for _, c := range r.Calls {
+		if c == nil || c.Method == "" {
+			return nil, errors.New("missing method")
+		}
+	}
+	return r, nil
+}
+
+// canonicalParams re-encodes params so that formatting and object key order
+// do not affect the cache key.
+func canonicalParams(p json.RawMessage) ([]byte, error) {
+	if len(bytes.TrimSpace(p)) == 0 {
+		return []byte("[]"), nil
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(p))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// cacheKey derives the cache key for the request from the chain, methods and
+// canonicalized params only, so identical questions from different clients
+// share an entry regardless of headers or JSON-RPC ids. Keys have the form
+// chain:method:hash, with "batch" as the method for batch requests.
+func (r *rpcRequest) cacheKey(chain string) (string, error) {
+	h := md5.New()
+	for _, c := range r.Calls {
+		cp, err := canonicalParams(c.Params)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(c.Method))
+		h.Write([]byte{0})
+		h.Write(cp)
+		h.Write([]byte{0})
+	}
+	method := r.Calls[0].Method
+	if r.Batch {
+		method = "batch"
+	}
+	return fmt.Sprintf("%s:%s:%x", chain, method, h.Sum(nil)), nil
+}
+
+// methodLabel returns the method for use as a metric label, or "other" for
+// methods ethlb does not know of.
+func methodLabel(method string) string {
+	if knownMethods[method] || immutableMethods[method] || uncachedMethods[method] {
+		return method
+	}
+	if _, ok := blockParamIndex[method]; ok {
+		return method
+	}
+	return "other"
+}
+
+// uncached reports whether any of the calls must never be cached.
+func (r *rpcRequest) uncached() bool {
+	for _, c := range r.Calls {
+		if uncachedMethods[c.Method] {
+			return true
+		}
+		for _, p := range uncachedPrefixes {
+			if strings.HasPrefix(c.Method, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stable reports whether the answer to the call does not change as the
+// chain grows: it is pinned to a block, or looks up immutable data by hash.
+// Transactions looked up by hash are only stable once they are mined.
+func (c *JSONRPCRequest) stable(result json.RawMessage) bool {
+	if c.pinned() {
+		return true
+	}
+	if !immutableMethods[c.Method] {
+		return false
+	}
+	if c.Method != "eth_getTransactionByHash" {
+		return true
+	}
+	var tx struct {
+		BlockNumber string `json:"blockNumber"`
+	}
+	return json.Unmarshal(result, &tx) == nil && tx.BlockNumber != ""
+}
+
+// ttl returns how long a normalized response to the request is cached.
+// Responses which may change with the next block are capped at
+// cacheUnpinnedTTL, and are not kept to be served stale.
+func (r *rpcRequest) ttl(body []byte) (time.Duration, bool) {
+	res := r.results(body)
+	if len(res) != len(r.Calls) {
+		return cacheUnpinnedTTL, false
+	}
+	for i, c := range r.Calls {
+		if !c.stable(res[i]) {
+			if cacheUnpinnedTTL < cacheTTL {
+				return cacheUnpinnedTTL, false
+			}
+			return cacheTTL, false
+		}
+	}
+	return cacheTTL, true
+}
+
+// normalizeResponse orders batch responses to match the request so they can
+// later be matched to a caller's ids by position.
+func (r *rpcRequest) normalizeResponse(body []byte) ([]byte, error) {
+	if !r.Batch {
+		return body, nil
+	}
+	var res []*rpcEnvelope
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	if len(res) != len(r.Calls) {
+		return nil, errors.New("batch response length mismatch")
+	}
+	byID := make(map[string]*rpcEnvelope, len(res))
+	for _, e := range res {
+		byID[string(e.ID)] = e
+	}
+	ordered := make([]*rpcEnvelope, len(r.Calls))
+	for i, c := range r.Calls {
+		e, ok := byID[string(c.ID)]
+		if !ok {
+			return nil, errors.New("batch response missing id " + string(c.ID))
+		}
+		delete(byID, string(c.ID))
+		ordered[i] = e
+	}
+	return json.Marshal(ordered)
+}
+
+// withIDs rewrites the ids of a cached response to those of the request.
+func (r *rpcRequest) withIDs(body []byte) ([]byte, error) {
+	if !r.Batch {
+		e := &rpcEnvelope{}
+		if err := json.Unmarshal(body, e); err != nil {
+			return nil, err
+		}
+		e.ID = r.Calls[0].ID
+		return json.Marshal(e)
+	}
+	var res []*rpcEnvelope
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	if len(res) != len(r.Calls) {
+		return nil, errors.New("batch response length mismatch")
+	}
+	for i, e := range res {
+		e.ID = r.Calls[i].ID
+	}
+	return json.Marshal(res)
+}
+
+// results returns the result of each call in a normalized response body, in
+// request order. Calls which errored have a nil result.
+func (r *rpcRequest) results(body []byte) []json.RawMessage {
+	var res []*rpcEnvelope
+	if r.Batch {
+		if err := json.Unmarshal(body, &res); err != nil {
+			return nil
+		}
+	} else {
+		e := &rpcEnvelope{}
+		if err := json.Unmarshal(body, e); err != nil {
+			return nil
+		}
+		res = []*rpcEnvelope{e}
+	}
+	rs := make([]json.RawMessage, len(res))
+	for i, e := range res {
+		rs[i] = e.Result
+	}
+	return rs
+}
+
+// writeRPCError responds with a JSON-RPC error for requests ethlb rejects
+// itself, before they reach an upstream.
+func writeRPCError(w http.ResponseWriter, status int, code int, message string) {
+	res := struct {
+		Jsonrpc string        `json:"jsonrpc"`
+		ID      interface{}   `json:"id"`
+		Error   *JSONRPCError `json:"error"`
+	}{
+		Jsonrpc: "2.0",
+		Error: &JSONRPCError{
+			Code:    code,
+			Message: message,
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.WithError(err).Error("failed to write json-rpc error")
+	}
+}
@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParseRPCRequest(t *testing.T, body string) *rpcRequest {
+	t.Helper()
+	r, err := parseRPCRequest([]byte(body))
+	if err != nil {
+		t.Fatalf("parseRPCRequest(%s) error = %v", body, err)
+	}
+	return r
+}
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   string
+		chainA string
+		chainB string
+		same   bool
+	}{
+		{
+			name:   "ids are ignored",
+			a:      `{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0xab","0x1"]}`,
+			b:      `{"jsonrpc":"2.0","id":"x","method":"eth_getBalance","params":["0xab","0x1"]}`,
+			chainA: "ethereum", chainB: "ethereum",
+			same: true,
+		},
+		{
+			name:   "formatting and key order are ignored",
+			a:      `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xab","data":"0x01"},"0x1"]}`,
+			b:      `{"id":2,"method":"eth_call","jsonrpc":"2.0","params":[ {"data":"0x01", "to":"0xab"}, "0x1" ]}`,
+			chainA: "ethereum", chainB: "ethereum",
+			same: true,
+		},
+		{
+			name:   "missing and empty params match",
+			a:      `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			b:      `{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}`,
+			chainA: "ethereum", chainB: "ethereum",
+			same: true,
+		},
+		{
+			name:   "params differ",
+			a:      `{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0xab","0x1"]}`,
+			b:      `{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0xab","0x2"]}`,
+			chainA: "ethereum", chainB: "ethereum",
+		},
+		{
+			name:   "methods differ",
+			a:      `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x1",false]}`,
+			b:      `{"jsonrpc":"2.0","id":1,"method":"eth_getUncleCountByBlockNumber","params":["0x1",false]}`,
+			chainA: "ethereum", chainB: "ethereum",
+		},
+		{
+			name:   "chains differ",
+			a:      `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			b:      `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			chainA: "ethereum", chainB: "polygon",
+		},
+		{
+			name:   "batch ids are ignored",
+			a:      `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"net_version"}]`,
+			b:      `[{"jsonrpc":"2.0","id":7,"method":"eth_chainId"},{"jsonrpc":"2.0","id":8,"method":"net_version"}]`,
+			chainA: "ethereum", chainB: "ethereum",
+			same: true,
+		},
+		{
+			name:   "batch order matters",
+			a:      `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"net_version"}]`,
+			b:      `[{"jsonrpc":"2.0","id":1,"method":"net_version"},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}]`,
+			chainA: "ethereum", chainB: "ethereum",
+		},
+		{
+			name:   "batch of one is not a single call",
+			a:      `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}]`,
+			b:      `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			chainA: "ethereum", chainB: "ethereum",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ka, err := mustParseRPCRequest(t, tt.a).cacheKey(tt.chainA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kb, err := mustParseRPCRequest(t, tt.b).cacheKey(tt.chainB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (ka == kb) != tt.same {
+				t.Errorf("cacheKey() = %s and %s, want same %v", ka, kb, tt.same)
+			}
+			if !strings.HasPrefix(ka, tt.chainA+":") {
+				t.Errorf("cacheKey() = %s, want chain prefix %s", ka, tt.chainA)
+			}
+		})
+	}
+}
+
+func TestNormalizeResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "single call is unchanged",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			body: `{"jsonrpc":"2.0","id":1,"result":"0x1"}`,
+			want: `{"jsonrpc":"2.0","id":1,"result":"0x1"}`,
+		},
+		{
+			name: "batch is ordered by request",
+			req:  `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":"b","method":"net_version"}]`,
+			body: `[{"jsonrpc":"2.0","id":"b","result":"1"},{"jsonrpc":"2.0","id":1,"result":"0x1"}]`,
+			want: `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":"b","result":"1"}]`,
+		},
+		{
+			name: "errors are kept",
+			req:  `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_foo"}]`,
+			body: `[{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"not found"}},{"jsonrpc":"2.0","id":1,"result":"0x1"}]`,
+			want: `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"not found"}}]`,
+		},
+		{
+			name:    "batch length mismatch",
+			req:     `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"net_version"}]`,
+			body:    `[{"jsonrpc":"2.0","id":1,"result":"0x1"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "batch missing id",
+			req:     `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"net_version"}]`,
+			body:    `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":3,"result":"1"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "batch duplicate id",
+			req:     `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"net_version"}]`,
+			body:    `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":1,"result":"1"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "batch answered with an object",
+			req:     `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}]`,
+			body:    `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid"}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mustParseRPCRequest(t, tt.req).normalizeResponse([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("normalizeResponse() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "single call",
+			req:  `{"jsonrpc":"2.0","id":"abc","method":"eth_chainId"}`,
+			body: `{"jsonrpc":"2.0","id":1,"result":"0x1"}`,
+			want: `{"jsonrpc":"2.0","id":"abc","result":"0x1"}`,
+		},
+		{
+			name: "null id",
+			req:  `{"jsonrpc":"2.0","id":null,"method":"eth_chainId"}`,
+			body: `{"jsonrpc":"2.0","id":1,"result":"0x1"}`,
+			want: `{"jsonrpc":"2.0","id":null,"result":"0x1"}`,
+		},
+		{
+			name: "result is kept verbatim",
+			req:  `{"jsonrpc":"2.0","id":2,"method":"eth_getBlockByNumber","params":["0x1",false]}`,
+			body: `{"jsonrpc":"2.0","id":1,"result":{"number":"0x1","hash":"0xab"}}`,
+			want: `{"jsonrpc":"2.0","id":2,"result":{"number":"0x1","hash":"0xab"}}`,
+		},
+		{
+			name: "error",
+			req:  `{"jsonrpc":"2.0","id":5,"method":"eth_call","params":[]}`,
+			body: `{"jsonrpc":"2.0","id":1,"error":{"code":3,"message":"execution reverted"}}`,
+			want: `{"jsonrpc":"2.0","id":5,"error":{"code":3,"message":"execution reverted"}}`,
+		},
+		{
+			name: "batch by position",
+			req:  `[{"jsonrpc":"2.0","id":"x","method":"eth_chainId"},{"jsonrpc":"2.0","id":9,"method":"net_version"}]`,
+			body: `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"result":"1"}]`,
+			want: `[{"jsonrpc":"2.0","id":"x","result":"0x1"},{"jsonrpc":"2.0","id":9,"result":"1"}]`,
+		},
+		{
+			name:    "batch length mismatch",
+			req:     `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"net_version"}]`,
+			body:    `[{"jsonrpc":"2.0","id":1,"result":"0x1"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid body",
+			req:     `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			body:    `not json`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mustParseRPCRequest(t, tt.req).withIDs([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("withIDs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("withIDs() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestTTL(t *testing.T) {
+	defer func(ttl, unpinned time.Duration) { cacheTTL, cacheUnpinnedTTL = ttl, unpinned }(cacheTTL, cacheUnpinnedTTL)
+	cacheTTL = 10 * time.Minute
+	cacheUnpinnedTTL = 2 * time.Second
+	tests := []struct {
+		name       string
+		req        string
+		body       string
+		wantTTL    time.Duration
+		wantStable bool
+	}{
+		{
+			name:       "block by number",
+			req:        `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x64",false]}`,
+			body:       `{"jsonrpc":"2.0","id":1,"result":{"number":"0x64"}}`,
+			wantTTL:    cacheTTL,
+			wantStable: true,
+		},
+		{
+			name:       "call by block hash",
+			req:        `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xab"},{"blockHash":"0xcd"}]}`,
+			body:       `{"jsonrpc":"2.0","id":1,"result":"0x01"}`,
+			wantTTL:    cacheTTL,
+			wantStable: true,
+		},
+		{
+			name:       "logs up to a block number",
+			req:        `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1","toBlock":"0x64"}]}`,
+			body:       `{"jsonrpc":"2.0","id":1,"result":[]}`,
+			wantTTL:    cacheTTL,
+			wantStable: true,
+		},
+		{
+			name:    "logs up to latest",
+			req:     `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1","toBlock":"latest"}]}`,
+			body:    `{"jsonrpc":"2.0","id":1,"result":[]}`,
+			wantTTL: cacheUnpinnedTTL,
+		},
+		{
+			name:    "call at latest",
+			req:     `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xab"},"latest"]}`,
+			body:    `{"jsonrpc":"2.0","id":1,"result":"0x01"}`,
+			wantTTL: cacheUnpinnedTTL,
+		},
+		{
+			name:    "default block is latest",
+			req:     `{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0xab"]}`,
+			body:    `{"jsonrpc":"2.0","id":1,"result":"0x0"}`,
+			wantTTL: cacheUnpinnedTTL,
+		},
+		{
+			name:    "block number",
+			req:     `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`,
+			body:    `{"jsonrpc":"2.0","id":1,"result":"0x64"}`,
+			wantTTL: cacheUnpinnedTTL,
+		},
+		{
+			name:       "mined transaction",
+			req:        `{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionByHash","params":["0xab"]}`,
+			body:       `{"jsonrpc":"2.0","id":1,"result":{"hash":"0xab","blockNumber":"0x64"}}`,
+			wantTTL:    cacheTTL,
+			wantStable: true,
+		},
+		{
+			name:    "pending transaction",
+			req:     `{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionByHash","params":["0xab"]}`,
+			body:    `{"jsonrpc":"2.0","id":1,"result":{"hash":"0xab","blockNumber":null}}`,
+			wantTTL: cacheUnpinnedTTL,
+		},
+		{
+			name:       "chain id",
+			req:        `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			body:       `{"jsonrpc":"2.0","id":1,"result":"0x1"}`,
+			wantTTL:    cacheTTL,
+			wantStable: true,
+		},
+		{
+			name:    "batch with one unpinned call",
+			req:     `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber"}]`,
+			body:    `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"result":"0x64"}]`,
+			wantTTL: cacheUnpinnedTTL,
+		},
+		{
+			name:    "unparsable body",
+			req:     `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			body:    `not json`,
+			wantTTL: cacheUnpinnedTTL,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, stable := mustParseRPCRequest(t, tt.req).ttl([]byte(tt.body))
+			if ttl != tt.wantTTL || stable != tt.wantStable {
+				t.Errorf("ttl() = %v, %v, want %v, %v", ttl, stable, tt.wantTTL, tt.wantStable)
+			}
+		})
+	}
+}
+
+func TestRequestUncached(t *testing.T) {
+	tests := []struct {
+		req  string
+		want bool
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["0x00"]}`, true},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_newFilter","params":[{}]}`, true},
+		{`{"jsonrpc":"2.0","id":1,"method":"personal_sign","params":[]}`, true},
+		{`{"jsonrpc":"2.0","id":1,"method":"admin_peers"}`, true},
+		{`[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_sendRawTransaction","params":["0x00"]}]`, true},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x1",false]}`, false},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`, false},
+	}
+	for _, tt := range tests {
+		if got := mustParseRPCRequest(t, tt.req).uncached(); got != tt.want {
+			t.Errorf("uncached(%s) = %v, want %v", tt.req, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/robertlestak/ethlb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// logsSplitBlocks is the largest eth_getLogs block range sent upstream
+	// in one call. Larger ranges are split into chunks. 0 disables splitting.
+	logsSplitBlocks uint64
+	// logsSplitConcurrency caps the chunks of one request fetched at once
+	logsSplitConcurrency = 4
+)
+
+func ConfigLogsSplitting() error {
+	l := log.WithFields(log.Fields{
+		"action": "ConfigLogsSplitting",
+	})
+	l.Debug("start")
+	var err error
+	if os.Getenv("LOGS_SPLIT_BLOCKS") != "" {
+		logsSplitBlocks, err = strconv.ParseUint(os.Getenv("LOGS_SPLIT_BLOCKS"), 10, 64)
+		if err != nil {
+			l.WithError(err).Error("failed to parse LOGS_SPLIT_BLOCKS")
+			return err
+		}
+	}
+	if os.Getenv("LOGS_SPLIT_CONCURRENCY") != "" {
+		logsSplitConcurrency, err = strconv.Atoi(os.Getenv("LOGS_SPLIT_CONCURRENCY"))
+		if err != nil {
+			l.WithError(err).Error("failed to parse LOGS_SPLIT_CONCURRENCY")
+			return err
+		}
+		if logsSplitConcurrency < 1 {
+			logsSplitConcurrency = 1
+		}
+	}
+	return nil
+}
+
+// logsChunk is one block range of a split eth_getLogs call and its result.
+type logsChunk struct {
+	from, to uint64
+	logs     []json.RawMessage
+	rpcErr   json.RawMessage
+	err      error
+}
+
+// splittableBlock reports whether a range bound resolves to the same block
+// on every endpoint once split. "safe", "finalized" and "pending" depend on
+// the endpoint, so ranges using them are not split.
+func splittableBlock(ref string) bool {
+	if _, ok := parseHexUint(ref); ok {
+		return true
+	}
+	return ref == "" || ref == "latest" || ref == "earliest"
+}
+
+// splitLogsFilter returns the chunks of at most logsSplitBlocks blocks
+// covering the filter's range with the chain at head, or nil if the filter
+// does not need splitting.
+func splitLogsFilter(f *logsFilter, head uint64) []*logsChunk {
+	if logsSplitBlocks == 0 || !splittableBlock(f.FromBlock) || !splittableBlock(f.ToBlock) {
+		return nil
+	}
+	n, ok := f.blockRange(head)
+	if !ok || n <= logsSplitBlocks {
+		return nil
+	}
+	from, _ := resolveBlock(f.FromBlock, head)
+	to, _ := resolveBlock(f.ToBlock, head)
+	// chunks are aligned to multiples of logsSplitBlocks so that requests
+	// for overlapping ranges share all but their first and last chunks
+	var chunks []*logsChunk
+	for s := from; ; {
+		e := (s/logsSplitBlocks+1)*logsSplitBlocks - 1
+		if e > to || e < s {
+			e = to
+		}
+		chunks = append(chunks, &logsChunk{from: s, to: e})
+		if e == to {
+			break
+		}
+		s = e + 1
+	}
+	return chunks
+}
+
+// fetch requests the chunk's range with the rest of the filter unchanged.
+// Chunk ranges are numeric so each chunk is cached under its own key, and
+// shared by any request covering the same range. Chunks are only sent to
+// endpoints which have reached their last block, so endpoints which are
+// behind don't answer with partial logs.
+func (ch *logsChunk) fetch(ctx context.Context, c *chain, f logsFilter, d cacheDirectives) {
+	f.FromBlock = fmt.Sprintf("0x%x", ch.from)
+	f.ToBlock = fmt.Sprintf("0x%x", ch.to)
+	fb, err := json.Marshal([]*logsFilter{&f})
+	if err != nil {
+		ch.err = err
+		return
+	}
+	body, err := json.Marshal(&JSONRPCRequest{
+		Jsonrpc: "2.0",
+		ID:      json.RawMessage("1"),
+		Method:  "eth_getLogs",
+		Params:  fb,
+	})
+	if err != nil {
+		ch.err = err
+		return
+	}
+	rb, err := c.call(ctx, body, d, ch.to)
+	if err != nil {
+		ch.err = err
+		return
+	}
+	res := &rpcEnvelope{}
+	if err := json.Unmarshal(rb, res); err != nil {
+		ch.err = err
+		return
+	}
+	if len(res.Error) > 0 && string(res.Error) != "null" {
+		ch.rpcErr = res.Error
+		return
+	}
+	if err := json.Unmarshal(res.Result, &ch.logs); err != nil {
+		ch.err = err
+	}
+}
+
+// serveSplitLogs answers a single eth_getLogs call spanning more than
+// logsSplitBlocks blocks by fetching its range in chunks, concurrently and
+// across endpoints, and merging the logs in block order. It returns false
+// without writing a response if the request is not split.
+func serveSplitLogs(w http.ResponseWriter, r *http.Request, chainName string, rr *rpcRequest) bool {
+	if logsSplitBlocks == 0 || rr == nil || rr.Batch {
+		return false
+	}
+	call := rr.Calls[0]
+	f := call.logsFilter()
+	if f == nil {
+		return false
+	}
+	var c *chain
+	for _, ch := range Chains {
+		if ch.Name == chainName {
+			c = ch
+		}
+	}
+	if c == nil {
+		return false
+	}
+	chunks := splitLogsFilter(f, c.head())
+	if len(chunks) == 0 {
+		return false
+	}
+	l := log.WithFields(log.Fields{
+		"chain":  chainName,
+		"action": "serveSplitLogs",
+		"from":   chunks[0].from,
+		"to":     chunks[len(chunks)-1].to,
+		"chunks": len(chunks),
+	})
+	l.Debug("splitting eth_getLogs")
+	d := parseCacheDirectives(r)
+	sem := make(chan struct{}, logsSplitConcurrency)
+	var wg sync.WaitGroup
+	for _, ch := range chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ch *logsChunk) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ch.fetch(r.Context(), c, *f, d)
+		}(ch)
+	}
+	wg.Wait()
+	res := struct {
+		Jsonrpc string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  interface{}     `json:"result,omitempty"`
+		Error   json.RawMessage `json:"error,omitempty"`
+	}{
+		Jsonrpc: "2.0",
+		ID:      call.ID,
+	}
+	if len(res.ID) == 0 {
+		res.ID = json.RawMessage("null")
+	}
+	logs := []json.RawMessage{}
+	for _, ch := range chunks {
+		if ch.err != nil {
+			l.WithError(ch.err).WithFields(log.Fields{
+				"chunkFrom": ch.from,
+				"chunkTo":   ch.to,
+			}).Error("failed to fetch logs chunk")
+			writeRPCError(w, http.StatusBadGateway, rpcErrInternal,
+				fmt.Sprintf("failed to fetch logs for blocks %d-%d: %v", ch.from, ch.to, ch.err))
+			metrics.HTTPRequests.WithLabelValues(metrics.URLLabel(r), strconv.Itoa(http.StatusBadGateway), r.Method).Inc()
+			return true
+		}
+		if ch.rpcErr != nil {
+			// pass the upstream's error through, e.g. too many results
+			res.Error = ch.rpcErr
+			break
+		}
+		logs = append(logs, ch.logs...)
+	}
+	if res.Error == nil {
+		res.Result = logs
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("x-ethlb-logs-chunks", strconv.Itoa(len(chunks)))
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		l.WithError(err).Error("failed to write merged logs")
+	}
+	metrics.HTTPRequests.WithLabelValues(metrics.URLLabel(r), strconv.Itoa(http.StatusOK), r.Method).Inc()
+	return true
+}
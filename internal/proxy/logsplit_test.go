@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitLogsFilter(t *testing.T) {
+	type span struct{ from, to uint64 }
+	tests := []struct {
+		name   string
+		blocks uint64
+		filter logsFilter
+		head   uint64
+		want   []span
+	}{
+		{
+			name:   "disabled",
+			blocks: 0,
+			filter: logsFilter{FromBlock: "0x0", ToBlock: "0x3e8"},
+			head:   1000,
+		},
+		{
+			name:   "within limit",
+			blocks: 100,
+			filter: logsFilter{FromBlock: "0x1", ToBlock: "0x64"},
+			head:   1000,
+		},
+		{
+			name:   "aligned chunks",
+			blocks: 100,
+			filter: logsFilter{FromBlock: "0x0", ToBlock: "0x12b"},
+			head:   1000,
+			want:   []span{{0, 99}, {100, 199}, {200, 299}},
+		},
+		{
+			name:   "unaligned bounds",
+			blocks: 100,
+			filter: logsFilter{FromBlock: "0x32", ToBlock: "0xfa"},
+			head:   1000,
+			want:   []span{{50, 99}, {100, 199}, {200, 250}},
+		},
+		{
+			name:   "one past the limit",
+			blocks: 100,
+			filter: logsFilter{FromBlock: "0x0", ToBlock: "0x64"},
+			head:   1000,
+			want:   []span{{0, 99}, {100, 100}},
+		},
+		{
+			name:   "latest resolves to head",
+			blocks: 100,
+			filter: logsFilter{FromBlock: "0x384", ToBlock: "latest"},
+			head:   1049,
+			want:   []span{{900, 999}, {1000, 1049}},
+		},
+		{
+			name:   "missing bounds resolve to head",
+			blocks: 100,
+			filter: logsFilter{},
+			head:   1049,
+		},
+		{
+			name:   "earliest",
+			blocks: 100,
+			filter: logsFilter{FromBlock: "earliest", ToBlock: "0x95"},
+			head:   1000,
+			want:   []span{{0, 99}, {100, 149}},
+		},
+		{
+			name:   "safe is not split",
+			blocks: 100,
+			filter: logsFilter{FromBlock: "0x0", ToBlock: "safe"},
+			head:   1000,
+		},
+		{
+			name:   "finalized is not split",
+			blocks: 100,
+			filter: logsFilter{FromBlock: "finalized", ToBlock: "latest"},
+			head:   1000,
+		},
+		{
+			name:   "pending is not split",
+			blocks: 100,
+			filter: logsFilter{FromBlock: "0x0", ToBlock: "pending"},
+			head:   1000,
+		},
+		{
+			name:   "block hash is not split",
+			blocks: 100,
+			filter: logsFilter{BlockHash: "0xab"},
+			head:   1000,
+		},
+		{
+			name:   "inverted range is not split",
+			blocks: 100,
+			filter: logsFilter{FromBlock: "0x3e8", ToBlock: "0x0"},
+			head:   1000,
+		},
+		{
+			name:   "invalid bound is not split",
+			blocks: 100,
+			filter: logsFilter{FromBlock: "0x0", ToBlock: "soon"},
+			head:   1000,
+		},
+	}
+	defer func(n uint64) { logsSplitBlocks = n }(logsSplitBlocks)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logsSplitBlocks = tt.blocks
+			var got []span
+			for _, ch := range splitLogsFilter(&tt.filter, tt.head) {
+				got = append(got, span{ch.from, ch.to})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitLogsFilter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
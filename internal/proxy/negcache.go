@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// negativeCacheRules select the empty and error responses which are
+	// cached. None are cached by default.
+	negativeCacheRules []*negativeCacheRule
+	// negativeCacheUnpinnedTTL caps the ttl of negative entries for calls
+	// which are not pinned to a block, as their answer can change with the
+	// next block.
+	negativeCacheUnpinnedTTL = time.Second * 2
+)
+
+// negativeCacheRule caches responses to Method with a null result (Match
+// "null"), any error (Match "*") or a specific error code for TTL.
+type negativeCacheRule struct {
+	Method string
+	Match  string
+	TTL    time.Duration
+}
+
+// JSONRPCError is the error object of a JSON-RPC response.
+type JSONRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// parseNegativeCacheRules parses rules of the form method:match:ttl
+// separated by commas, e.g. "eth_getTransactionReceipt:null:30s,eth_call:3:5m".
+// A method of "*" matches every method.
+func parseNegativeCacheRules(s string) ([]*negativeCacheRule, error) {
+	var rules []*negativeCacheRule
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		p := strings.Split(r, ":")
+		if len(p) != 3 || p[0] == "" {
+			return nil, errors.New("invalid negative cache rule " + r)
+		}
+		if p[1] != "null" && p[1] != "*" {
+			if _, err := strconv.Atoi(p[1]); err != nil {
+				return nil, errors.New("invalid negative cache match " + p[1])
+			}
+		}
+		ttl, err := time.ParseDuration(p[2])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &negativeCacheRule{
+			Method: p[0],
+			Match:  p[1],
+			TTL:    ttl,
+		})
+	}
+	return rules, nil
+}
+
+func ConfigNegativeCache() error {
+	l := log.WithFields(log.Fields{
+		"action": "ConfigNegativeCache",
+	})
+	l.Debug("start")
+	var err error
+	if os.Getenv("NEGATIVE_CACHE_RULES") != "" {
+		negativeCacheRules, err = parseNegativeCacheRules(os.Getenv("NEGATIVE_CACHE_RULES"))
+		if err != nil {
+			l.WithError(err).Error("failed to parse NEGATIVE_CACHE_RULES")
+			return err
+		}
+	}
+	if os.Getenv("NEGATIVE_CACHE_UNPINNED_TTL") != "" {
+		negativeCacheUnpinnedTTL, err = time.ParseDuration(os.Getenv("NEGATIVE_CACHE_UNPINNED_TTL"))
+		if err != nil {
+			l.WithError(err).Error("failed to parse NEGATIVE_CACHE_UNPINNED_TTL")
+			return err
+		}
+	}
+	l.WithField("rules", len(negativeCacheRules)).Debug("configured negative cache")
+	return nil
+}
+
+func (r *negativeCacheRule) matches(c *JSONRPCRequest, res *JSONRPCResponse) bool {
+	if r.Method != "*" && r.Method != c.Method {
+		return false
+	}
+	switch r.Match {
+	case "null":
+		return res.Error == nil && res.Result == nil
+	case "*":
+		return res.Error != nil
+	}
+	return res.Error != nil && strconv.Itoa(res.Error.Code) == r.Match
+}
+
+// negativeTTL returns how long a null or error response to the call, answered
+// with the chain at head, may be cached, if at all. The first matching rule
+// applies.
+func negativeTTL(c *JSONRPCRequest, res *JSONRPCResponse, head uint64) (time.Duration, bool) {
+	for _, r := range negativeCacheRules {
+		if !r.matches(c, res) {
+			continue
+		}
+		ttl := r.TTL
+		if !c.settled(head) && ttl > negativeCacheUnpinnedTTL {
+			ttl = negativeCacheUnpinnedTTL
+		}
+		return ttl, ttl > 0
+	}
+	return 0, false
+}
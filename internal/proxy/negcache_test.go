@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseNegativeCacheRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		want    []*negativeCacheRule
+		wantErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "null result",
+			rules: "eth_getTransactionReceipt:null:30s",
+			want:  []*negativeCacheRule{{Method: "eth_getTransactionReceipt", Match: "null", TTL: 30 * time.Second}},
+		},
+		{
+			name:  "multiple rules",
+			rules: "eth_getTransactionReceipt:null:30s, eth_call:3:5m,*:*:1s",
+			want: []*negativeCacheRule{
+				{Method: "eth_getTransactionReceipt", Match: "null", TTL: 30 * time.Second},
+				{Method: "eth_call", Match: "3", TTL: 5 * time.Minute},
+				{Method: "*", Match: "*", TTL: time.Second},
+			},
+		},
+		{
+			name:  "negative error code",
+			rules: "eth_call:-32000:10s",
+			want:  []*negativeCacheRule{{Method: "eth_call", Match: "-32000", TTL: 10 * time.Second}},
+		},
+		{
+			name:  "empty entries are skipped",
+			rules: ",eth_call:3:1m,,",
+			want:  []*negativeCacheRule{{Method: "eth_call", Match: "3", TTL: time.Minute}},
+		},
+		{
+			name:    "missing ttl",
+			rules:   "eth_call:3",
+			wantErr: true,
+		},
+		{
+			name:    "too many fields",
+			rules:   "eth_call:3:1m:x",
+			wantErr: true,
+		},
+		{
+			name:    "missing method",
+			rules:   ":null:1m",
+			wantErr: true,
+		},
+		{
+			name:    "invalid match",
+			rules:   "eth_call:reverted:1m",
+			wantErr: true,
+		},
+		{
+			name:    "invalid ttl",
+			rules:   "eth_call:3:forever",
+			wantErr: true,
+		},
+		{
+			name:    "one invalid rule fails all",
+			rules:   "eth_call:3:1m,eth_getLogs:null",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNegativeCacheRules(tt.rules)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNegativeCacheRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNegativeCacheRules() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	defer func(rules []*negativeCacheRule, unpinned time.Duration, depth uint64) {
+		negativeCacheRules, negativeCacheUnpinnedTTL, reorgTrackDepth = rules, unpinned, depth
+	}(negativeCacheRules, negativeCacheUnpinnedTTL, reorgTrackDepth)
+	negativeCacheRules = []*negativeCacheRule{
+		{Method: "eth_getBlockByNumber", Match: "null", TTL: time.Minute},
+		{Method: "eth_call", Match: "3", TTL: 5 * time.Minute},
+		{Method: "*", Match: "-32000", TTL: 0},
+	}
+	negativeCacheUnpinnedTTL = 2 * time.Second
+	reorgTrackDepth = 64
+	null := &JSONRPCResponse{}
+	reverted := &JSONRPCResponse{Error: &JSONRPCError{Code: 3}}
+	tests := []struct {
+		name      string
+		req       string
+		res       *JSONRPCResponse
+		head      uint64
+		wantTTL   time.Duration
+		wantCache bool
+	}{
+		{
+			name:      "settled block",
+			req:       `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x64",false]}`,
+			res:       null,
+			head:      1000,
+			wantTTL:   time.Minute,
+			wantCache: true,
+		},
+		{
+			name:      "block above head",
+			req:       `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x3e9",false]}`,
+			res:       null,
+			head:      1000,
+			wantTTL:   2 * time.Second,
+			wantCache: true,
+		},
+		{
+			name:      "block within the reorg depth",
+			req:       `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x3c0",false]}`,
+			res:       null,
+			head:      1000,
+			wantTTL:   2 * time.Second,
+			wantCache: true,
+		},
+		{
+			name:      "block at the reorg depth",
+			req:       `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x3a8",false]}`,
+			res:       null,
+			head:      1000,
+			wantTTL:   time.Minute,
+			wantCache: true,
+		},
+		{
+			name:      "call by block hash",
+			req:       `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xab"},{"blockHash":"0xcd"}]}`,
+			res:       reverted,
+			head:      1000,
+			wantTTL:   5 * time.Minute,
+			wantCache: true,
+		},
+		{
+			name:      "call at latest",
+			req:       `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xab"},"latest"]}`,
+			res:       reverted,
+			head:      1000,
+			wantTTL:   2 * time.Second,
+			wantCache: true,
+		},
+		{
+			name: "error code without a rule",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xab"},"0x64"]}`,
+			res:  &JSONRPCResponse{Error: &JSONRPCError{Code: -32602}},
+			head: 1000,
+		},
+		{
+			name: "zero ttl rule",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xab"},"0x64"]}`,
+			res:  &JSONRPCResponse{Error: &JSONRPCError{Code: -32000}},
+			head: 1000,
+		},
+		{
+			name: "null without a rule",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionReceipt","params":["0xab"]}`,
+			res:  null,
+			head: 1000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseRPCRequest([]byte(tt.req))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ttl, cache := negativeTTL(r.Calls[0], tt.res, tt.head)
+			if ttl != tt.wantTTL || cache != tt.wantCache {
+				t.Errorf("negativeTTL() = %v, %v, want %v, %v", ttl, cache, tt.wantTTL, tt.wantCache)
+			}
+		})
+	}
+}
@@ -4,8 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
-	"crypto/md5"
-	"crypto/tls"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -18,6 +17,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/robertlestak/ethlb/internal/cache"
@@ -37,10 +37,39 @@ var (
 		504,
 	}
 	cacheTTL = time.Minute * 10
+	// cacheUnpinnedTTL caps the ttl of responses which can change with the
+	// next block, such as calls at "latest", and should be about one block
+	cacheUnpinnedTTL = time.Second * 2
+	// cacheStaleTTL is how long past cacheTTL a stale entry is served while
+	// it is refreshed in the background
+	cacheStaleTTL time.Duration
+	// cacheStaleIfErrorTTL is how long past cacheTTL a stale entry is served
+	// when the upstream request fails
+	cacheStaleIfErrorTTL time.Duration
+	// endpointAcquireTimeout is how long a request waits for an endpoint
+	// with capacity
+	endpointAcquireTimeout = time.Second
+	// refreshing holds the cache keys of stale entries being refreshed
+	refreshing sync.Map
+	// cachedHeaders are the upstream response headers kept in cache entries
+	cachedHeaders = []string{
+		"Content-Type",
+	}
 )
 
 type transport struct {
-	http.RoundTripper
+	chain string
+	// endpoint is the endpoint preferred for the request, and once an
+	// attempt is made, the endpoint it was sent to
+	endpoint *ChainEndpoint
+	readOnly bool
+	// minHead excludes endpoints which have not reached the block
+	minHead uint64
+	// directives are the client's cache controls for the request
+	directives cacheDirectives
+	// internal requests, such as cache warming, are not counted in
+	// request and cache metrics
+	internal bool
 }
 
 type JSONRPCContainer struct {
@@ -48,9 +77,10 @@ type JSONRPCContainer struct {
 	Batch  []JSONRPCResponse
 }
 type JSONRPCResponse struct {
-	Jsonrpc string      `json:"jsonrpc"`
-	ID      int         `json:"id"`
-	Result  interface{} `json:"result"`
+	Jsonrpc string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
 }
 
 func intInSlice(a int, list []int) bool {
@@ -62,6 +92,24 @@ func intInSlice(a int, list []int) bool {
 	return false
 }
 
+// sleepRetry waits retryDelay before the next attempt, returning false if
+// ctx is done first.
+func sleepRetry(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(retryDelay):
+		return true
+	}
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func ConfigRetryHandler() error {
 	l := log.WithFields(log.Fields{
 		"package": "proxy",
@@ -102,6 +150,35 @@ func ConfigRetryHandler() error {
 			return err
 		}
 	}
+	if os.Getenv("CACHE_UNPINNED_TTL") != "" {
+		cacheUnpinnedTTL, err = time.ParseDuration(os.Getenv("CACHE_UNPINNED_TTL"))
+		if err != nil {
+			l.WithError(err).Error("failed to parse CACHE_UNPINNED_TTL")
+			return err
+		}
+	}
+	if os.Getenv("ENDPOINT_ACQUIRE_TIMEOUT") != "" {
+		endpointAcquireTimeout, err = time.ParseDuration(os.Getenv("ENDPOINT_ACQUIRE_TIMEOUT"))
+		if err != nil {
+			l.WithError(err).Error("failed to parse ENDPOINT_ACQUIRE_TIMEOUT")
+			return err
+		}
+	}
+	if os.Getenv("CACHE_STALE_TTL") != "" {
+		cacheStaleTTL, err = time.ParseDuration(os.Getenv("CACHE_STALE_TTL"))
+		if err != nil {
+			l.WithError(err).Error("failed to parse CACHE_STALE_TTL")
+			return err
+		}
+	}
+	cacheStaleIfErrorTTL = cacheStaleTTL
+	if os.Getenv("CACHE_STALE_IF_ERROR_TTL") != "" {
+		cacheStaleIfErrorTTL, err = time.ParseDuration(os.Getenv("CACHE_STALE_IF_ERROR_TTL"))
+		if err != nil {
+			l.WithError(err).Error("failed to parse CACHE_STALE_IF_ERROR_TTL")
+			return err
+		}
+	}
 	return nil
 }
 
@@ -126,6 +203,47 @@ func respFromCache(cd string) (resp *http.Response, err error) {
 	return resp, nil
 }
 
+func respFromEntry(e *cache.Entry, req *http.Request) *http.Response {
+	h := e.Header.Clone()
+	h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// setEntryHeaders reports the age and source endpoint of a cached response.
+func setEntryHeaders(resp *http.Response, e *cache.Entry, now time.Time) {
+	resp.Header.Set("x-ethlb-cache-age", strconv.Itoa(int(now.Sub(e.CreatedAt).Seconds())))
+	if e.Endpoint != "" {
+		resp.Header.Set("x-ethlb-endpoint", endpointHost(e.Endpoint))
+	}
+}
+
+// respFromCacheData builds a response to rr from cached data, reading
+// entries stored in the legacy base64 response dump format as well. The
+// decoded entry is returned alongside, or nil for legacy entries.
+func respFromCacheData(cd string, req *http.Request, rr *rpcRequest) (*http.Response, *cache.Entry, error) {
+	e, err := cache.DecodeEntry(cd)
+	if err == cache.ErrLegacyEntry {
+		resp, err := respFromCache(cd)
+		return resp, nil, err
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if e.Body, err = rr.withIDs(e.Body); err != nil {
+		return nil, nil, err
+	}
+	return respFromEntry(e, req), e, nil
+}
+
 func debugReqResp(req *http.Request, resp *http.Response) error {
 	l := log.WithFields(log.Fields{
 		"package": "proxy",
@@ -199,7 +317,7 @@ func (c *JSONRPCContainer) Unmarshal(b []byte) error {
 	return nil
 }
 
-func (t *transport) reqRoundTripper(req *http.Request, cacheKey string) (resp *http.Response, err error) {
+func (t *transport) reqRoundTripper(req *http.Request, cacheKey string, rr *rpcRequest) (resp *http.Response, err error) {
 	l := log.WithFields(log.Fields{
 		"package": "proxy",
 		"method":  "reqRoundTripper",
@@ -207,7 +325,15 @@ func (t *transport) reqRoundTripper(req *http.Request, cacheKey string) (resp *h
 	l.Debug("start")
 	defer l.Debug("end")
 	var cerr error
-	resp, err = t.RoundTripper.RoundTrip(req)
+	// capacity is reserved per attempt, after the cache lookup missed
+	e, err := acquireEndpoint(req.Context(), t.chain, t.endpoint, t.readOnly, t.minHead)
+	if err != nil {
+		return nil, err
+	}
+	defer e.release(t.chain)
+	t.endpoint = e
+	setEndpointURL(req, e)
+	resp, err = e.transport.RoundTrip(req)
 	if err != nil {
 		l.WithError(err).Error("failed to round trip")
 		return nil, err
@@ -251,37 +377,124 @@ func (t *transport) reqRoundTripper(req *http.Request, cacheKey string) (resp *h
 		err = rpcres.Unmarshal(pd)
 	}
 	cacheable := false
+	// negative is the ttl of a cacheable null or error response
+	var negative time.Duration
 	if resp.StatusCode == http.StatusOK &&
+		cacheKey != "" &&
 		os.Getenv("CACHE_DISABLED") != "true" &&
-		((rpcres.Single != nil && rpcres.Single.Result != nil) ||
-			(rpcres.Batch != nil && len(rpcres.Batch) > 0)) {
-		cacheable = true
+		!t.directives.noStore {
+		if (rpcres.Single != nil && rpcres.Single.Result != nil) ||
+			(rpcres.Batch != nil && len(rpcres.Batch) > 0) {
+			cacheable = true
+		} else if rpcres.Single != nil && !rr.Batch {
+			negative, cacheable = negativeTTL(rr.Calls[0], rpcres.Single, t.endpoint.blockHead())
+		}
 	}
 	l.Debug("cacheable: ", cacheable)
 	if cacheable {
 		l.Debug("set cache")
-		rd, err := httputil.DumpResponse(resp, true)
+		nd, err := rr.normalizeResponse(pd)
 		if err != nil {
-			l.WithError(err).Error("failed to dump response")
+			// the response can't be matched to the request, serve it uncached
+			l.WithError(err).Debug("failed to normalize response")
+			return resp, nil
+		}
+		now := time.Now()
+		ttl, stable := rr.ttl(nd)
+		ce := &cache.Entry{
+			StatusCode:  resp.StatusCode,
+			Header:      make(http.Header),
+			Body:        nd,
+			Endpoint:    t.endpoint.Endpoint,
+			BlockHeight: t.endpoint.blockHead(),
+			CreatedAt:   now,
+		}
+		if negative > 0 {
+			// negative entries are short lived and never served stale
+			ttl = negative
+		} else if stale := maxDuration(cacheStaleTTL, cacheStaleIfErrorTTL); stale > 0 && stable {
+			// keep the entry around past its ttl so it can be served stale
+			ce.SoftExpiry = now.Add(ttl)
+			ce.HardExpiry = ce.SoftExpiry.Add(stale)
+			ttl += stale
+		}
+		for _, h := range cachedHeaders {
+			if v := resp.Header.Get(h); v != "" {
+				ce.Header.Set(h, v)
+			}
+		}
+		encoded, err := ce.Encode()
+		if err != nil {
+			l.WithError(err).Error("failed to encode cache entry")
 			return nil, err
 		}
-		encoded := base64.StdEncoding.EncodeToString(rd)
-		cerr = cache.Set(cacheKey, encoded, cacheTTL)
+		cerr = cache.Set(cacheKey, encoded, ttl)
 		if cerr != nil {
 			l.WithError(cerr).Error("failed to set cache")
+		} else {
+			indexCacheEntry(t.chain, cacheKey, rr, nd, ce.BlockHeight, ttl)
 		}
 	}
 	return resp, nil
 }
 
+// refresh fetches a stale cache entry again in the background, caching the
+// new response. Concurrent refreshes of the same key are deduplicated.
+func (t *transport) refresh(req *http.Request, body []byte, cacheKey string, rr *rpcRequest) {
+	l := log.WithFields(log.Fields{
+		"package": "proxy",
+		"method":  "refresh",
+		"cache":   cacheKey,
+	})
+	if runCtx.Err() != nil {
+		l.Debug("shutting down, not refreshing")
+		return
+	}
+	if _, running := refreshing.LoadOrStore(cacheKey, true); running {
+		l.Debug("refresh already running")
+		return
+	}
+	// the client request is done by the time the refresh completes, so the
+	// refresh is bound to ethlb's lifetime instead
+	rreq := req.Clone(runCtx)
+	rreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	rreq.ContentLength = int64(len(body))
+	rt := *t
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		defer refreshing.Delete(cacheKey)
+		resp, err := rt.reqRoundTripper(rreq, cacheKey, rr)
+		if err != nil {
+			l.WithError(err).Warn("failed to refresh stale cache entry")
+			return
+		}
+		resp.Body.Close()
+		l.WithField("status", resp.StatusCode).Debug("refreshed stale cache entry")
+	}()
+}
+
+// setEndpointURL points the request at the endpoint.
+func setEndpointURL(req *http.Request, e *ChainEndpoint) {
+	u, err := url.Parse(e.Endpoint)
+	if err != nil {
+		return
+	}
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+	req.Host = u.Host
+	req.URL.Path = u.Path
+}
+
 func cleanReq(req *http.Request) {
 	l := log.WithFields(log.Fields{
 		"package": "proxy",
 		"method":  "cleanReq",
 	})
 	l.Debug("start")
+	// the client's Authorization is never sent upstream, endpoints are
+	// authenticated with their configured credentials instead
 	var protected = []string{
-		"Authorization",
 		"Content-Type",
 		"Accept",
 		"Content-Length",
@@ -316,46 +529,68 @@ func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		defer req.Body.Close()
 	}
 	l.Debug("round trip")
-	vars := mux.Vars(req)
-	chain := vars["chain"]
-	var bd []byte
+	chain := t.chain
 	var rbd []byte
 	if req.Body != nil {
-		// drop host from cache key
 		cleanReq(req)
-		bd, err = httputil.DumpRequest(req, true)
-		if err != nil {
-			l.WithError(err).Error("failed to dump request")
-			return nil, err
-		}
 		rbd, err = ioutil.ReadAll(req.Body)
 		if err != nil {
 			l.WithError(err).Error("failed to read request body")
 			return nil, err
 		}
-		l.Debug("request: ", string(bd))
+		l.Debug("request: ", string(rbd))
 	}
-	rh := fmt.Sprintf("%x", md5.Sum(bd))
-	cacheKey := chain + ":" + rh
-	// if server supports cache, and client does not have ethlbcache=false header, cache
-	if os.Getenv("CACHE_DISABLED") != "true" && req.Header.Get("ethlbcache") != "false" {
+	// requests which are not valid JSON-RPC are proxied but never cached
+	var cacheKey string
+	rr, perr := parseRPCRequest(rbd)
+	if perr != nil {
+		l.WithError(perr).Debug("not a json-rpc request")
+	} else if rr.uncached() {
+		l.Debug("request is never cached")
+	} else if cacheKey, err = rr.cacheKey(chain); err != nil {
+		l.WithError(err).Debug("failed to derive cache key")
+		cacheKey = ""
+	}
+	l = l.WithField("cache", cacheKey)
+	// stale is an expired entry which may still be served if the upstream
+	// request fails
+	var stale *cache.Entry
+	// if server supports cache, and client did not ask to skip it, cache
+	if cacheKey != "" && os.Getenv("CACHE_DISABLED") != "true" && !t.directives.noRead {
 		cd, cerr := cache.Get(cacheKey)
-		l = l.WithField("cache", cacheKey)
 		if cerr != nil {
 			l.WithError(cerr).Error("get cache")
 		}
 		if cd != "" {
 			l.Debug("cache hit")
-			resp, err = respFromCache(cd)
-			if err != nil {
-				l.WithError(err).Error("failed to read response from cache")
-				return nil, err
+			cresp, ce, rerr := respFromCacheData(cd, req, rr)
+			now := time.Now()
+			if rerr != nil {
+				// unreadable entries are treated as a miss and overwritten
+				l.WithError(rerr).Error("failed to read response from cache")
+			} else if t.directives.hasMaxAge && (ce == nil || now.Sub(ce.CreatedAt) > t.directives.maxAge) {
+				l.Debug("cached response older than client max-age")
+			} else if ce == nil || !ce.Stale(now) || now.Before(ce.SoftExpiry.Add(cacheStaleTTL)) {
+				l.Debugf("response: %s", string(rbd))
+				if ce != nil && ce.Stale(now) {
+					l.Debug("serve stale response while refreshing")
+					cresp.Header.Set("x-ethlb-cache", "stale")
+					t.refresh(req, rbd, cacheKey, rr)
+				} else {
+					cresp.Header.Set("x-ethlb-cache", "hit")
+				}
+				if ce != nil {
+					setEntryHeaders(cresp, ce, now)
+				}
+				if !t.internal {
+					metrics.CacheHit.WithLabelValues(chain, strconv.Itoa(cresp.StatusCode), req.Method).Inc()
+					recordCacheHit(chain)
+				}
+				l.Debug("send response from cache")
+				return cresp, nil
+			} else if now.Before(ce.HardExpiry) {
+				stale = ce
 			}
-			l.Debugf("response: %s", string(rbd))
-			resp.Header.Set("x-ethlb-cache", "hit")
-			metrics.CacheHit.WithLabelValues(chain, strconv.Itoa(resp.StatusCode), req.Method).Inc()
-			l.Debug("send response from cache")
-			return resp, nil
 		}
 	}
 	l.Debug("cache miss")
@@ -365,11 +600,27 @@ func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		l.Debugf("round trip %+v", req)
 		l.Debugf("body dump %+s", rbd)
 		req.Body = ioutil.NopCloser(bytes.NewReader(rbd))
-		resp, err = t.reqRoundTripper(req, cacheKey)
-		if err != nil {
+		resp, err = t.reqRoundTripper(req, cacheKey, rr)
+		if err == errEndpointsBusy || err == errEndpointsBehind {
+			if stale != nil {
+				l.WithError(err).Warn("serve stale response while no endpoint is available")
+				sresp := respFromEntry(stale, req)
+				sresp.Header.Set("x-ethlb-cache", "stale")
+				setEntryHeaders(sresp, stale, time.Now())
+				return sresp, nil
+			}
+			return nil, err
+		} else if err != nil && req.Context().Err() != nil {
+			// the client went away or ethlb is shutting down, which says
+			// nothing about the endpoint
+			l.WithError(err).Debug("request canceled")
+			return nil, err
+		} else if err != nil {
 			l.WithError(err).Error("failed to round trip")
 			retries++
-			time.Sleep(retryDelay)
+			if !sleepRetry(req.Context()) {
+				return nil, req.Context().Err()
+			}
 			continue
 		}
 		defer resp.Body.Close()
@@ -377,7 +628,9 @@ func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		if intInSlice(resp.StatusCode, retryableCodes) {
 			l.WithField("status", resp.StatusCode).Debug("retryable status code")
 			retries++
-			time.Sleep(retryDelay)
+			if !sleepRetry(req.Context()) {
+				return nil, req.Context().Err()
+			}
 			continue
 		} else {
 			l.WithField("status", resp.StatusCode).Debug("non-retryable status code")
@@ -386,9 +639,16 @@ func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 	}
 	if retries >= maxRetries {
 		l.Error("max retries reached")
-		if cerr := CooldownEndpoint(chain, req.URL.String()); cerr != nil {
+		if cerr := CooldownEndpoint(chain, t.endpoint.Endpoint); cerr != nil {
 			l.WithError(cerr).Error("failed to cooldown endpoint")
 		}
+		if stale != nil {
+			l.Warn("serve stale response after upstream failure")
+			sresp := respFromEntry(stale, req)
+			sresp.Header.Set("x-ethlb-cache", "stale")
+			setEntryHeaders(sresp, stale, time.Now())
+			return sresp, nil
+		}
 		var retErr error
 		if err != nil {
 			retErr = err
@@ -400,10 +660,14 @@ func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		return nil, retErr
 	}
 	resp.Header.Set("x-ethlb-cache", "miss")
+	resp.Header.Set("x-ethlb-endpoint", endpointHost(t.endpoint.Endpoint))
 	l.Debug("return response")
 	l.Debugf("response %+v", resp.StatusCode)
-	metrics.HTTPRequests.WithLabelValues(req.URL.String(), strconv.Itoa(resp.StatusCode), req.Method).Inc()
-	metrics.CacheMiss.WithLabelValues(chain, strconv.Itoa(resp.StatusCode), req.Method).Inc()
+	if !t.internal {
+		metrics.HTTPRequests.WithLabelValues(req.URL.String(), strconv.Itoa(resp.StatusCode), req.Method).Inc()
+		metrics.CacheMiss.WithLabelValues(chain, strconv.Itoa(resp.StatusCode), req.Method).Inc()
+		recordCacheMiss(chain)
+	}
 	return resp, nil
 }
 
@@ -412,12 +676,32 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	chain := vars["chain"]
 	l := log.WithFields(log.Fields{
 		"remote": r.RemoteAddr,
-		"url":    r.URL.String(),
+		"url":    metrics.URLLabel(r),
 		"chain":  chain,
 		"action": "proxy.Handler",
 	})
 	l.Debug("start")
 	defer l.Debug("end")
+	rr, perr := readRPCRequest(r)
+	if perr != nil {
+		l.WithError(perr).Debug("not a json-rpc request")
+	}
+	if !checkRequestLimits(w, chain, rr, perr) {
+		return
+	}
+	k, ok := authorizeRequest(w, r, chain, rr)
+	if !ok {
+		return
+	}
+	if !checkMethodPolicy(w, r, chain, k, rr, perr) {
+		return
+	}
+	if !rateLimitRequest(w, r, chain, k, rr) {
+		return
+	}
+	if serveSplitLogs(w, r, chain, rr) {
+		return
+	}
 	l.Debug("get endpoint")
 	var readOnly bool
 	if strings.HasSuffix(r.URL.Path, "/read") {
@@ -428,49 +712,37 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		l.WithError(err).Error("failed to get endpoint")
 		w.WriteHeader(http.StatusInternalServerError)
-		metrics.HTTPRequests.WithLabelValues(r.URL.String(), strconv.Itoa(http.StatusInternalServerError), r.Method).Inc()
+		metrics.HTTPRequests.WithLabelValues(metrics.URLLabel(r), strconv.Itoa(http.StatusInternalServerError), r.Method).Inc()
 		return
 	}
 	l.Debug("create director")
 	d := func(req *http.Request) {
-		u, err := url.Parse(endpoint)
-		if err != nil {
-			l.WithError(err).Error("failed to parse endpoint")
-			w.WriteHeader(http.StatusInternalServerError)
-			metrics.HTTPRequests.WithLabelValues(req.URL.String(), strconv.Itoa(http.StatusInternalServerError), r.Method).Inc()
-			return
-		}
-		req.URL.Scheme = u.Scheme
-		req.URL.Host = u.Host
-		req.Host = u.Host
-		req.URL.Path = u.Path
+		setEndpointURL(req, endpoint)
+		stripCacheDirectives(req.URL)
 		l.Debugf("proxying to %s", req.URL.String())
 	}
 	l.Debug("create error handler")
 	e := func(w http.ResponseWriter, r *http.Request, e error) {
+		if e == errEndpointsBusy {
+			w.Header().Set("Retry-After", "1")
+			writeRPCError(w, http.StatusServiceUnavailable, rpcErrLimitExceeded, e.Error())
+			metrics.HTTPRequests.WithLabelValues(metrics.URLLabel(r), strconv.Itoa(http.StatusServiceUnavailable), r.Method).Inc()
+			return
+		}
 		l.WithError(e).Error("failed to proxy")
 		http.Error(w, e.Error(), http.StatusBadGateway)
-		metrics.HTTPRequests.WithLabelValues(r.URL.String(), strconv.Itoa(http.StatusBadGateway), r.Method).Inc()
-	}
-	l.Debug("create transport")
-	defaultTransport := http.DefaultTransport.(*http.Transport)
-	customTransport := &http.Transport{
-		Proxy:               defaultTransport.Proxy,
-		DialContext:         defaultTransport.DialContext,
-		MaxIdleConns:        10000,
-		MaxIdleConnsPerHost: 10000,
-		//DisableKeepAlives:     true,
-		IdleConnTimeout:       defaultTransport.IdleConnTimeout,
-		ExpectContinueTimeout: defaultTransport.ExpectContinueTimeout,
-		TLSHandshakeTimeout:   defaultTransport.TLSHandshakeTimeout,
-		ResponseHeaderTimeout: defaultTransport.ResponseHeaderTimeout,
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		metrics.HTTPRequests.WithLabelValues(metrics.URLLabel(r), strconv.Itoa(http.StatusBadGateway), r.Method).Inc()
 	}
 	l.Debug("create proxy")
 	p := &httputil.ReverseProxy{
 		Director:     d,
 		ErrorHandler: e,
-		Transport:    &transport{customTransport},
+		Transport: &transport{
+			chain:      chain,
+			endpoint:   endpoint,
+			readOnly:   readOnly,
+			directives: parseCacheDirectives(r),
+		},
 	}
 	l.Debug("proxy request")
 	p.ServeHTTP(w, r)
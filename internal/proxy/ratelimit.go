@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/auth"
+	"github.com/robertlestak/ethlb/internal/metrics"
+	"github.com/robertlestak/ethlb/internal/ratelimit"
+	log "github.com/sirupsen/logrus"
+)
+
+// rateLimitRequest takes the cost of the request's calls from the client's
+// and the chain's rate limits. Clients are identified by API key, or by IP
+// without one. It writes an error response and returns false if the request
+// is over a limit.
+func rateLimitRequest(w http.ResponseWriter, r *http.Request, chainName string, k *auth.Key, rr *rpcRequest) bool {
+	client := "ip:" + ratelimit.ClientIP(r.RemoteAddr, r.Header.Get("X-Forwarded-For"))
+	label := "anonymous"
+	var clientRate, chainRate *ratelimit.Rate
+	if k != nil {
+		client = "key:" + k.ID()
+		label = k.Label()
+		clientRate = k.RateLimit
+	}
+	for _, c := range Chains {
+		if c.Name == chainName {
+			chainRate = c.RateLimit
+		}
+	}
+	cost := 1.0
+	if rr != nil {
+		cost = 0
+		for _, c := range rr.Calls {
+			cost += ratelimit.Cost(c.Method)
+		}
+	}
+	ok, wait := ratelimit.Allow(client, clientRate, chainName, chainRate, cost)
+	if ok {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"chain":  chainName,
+		"action": "rateLimitRequest",
+		"client": label,
+		"cost":   cost,
+		"wait":   wait,
+	}).Debug("rate limited")
+	metrics.RateLimited.WithLabelValues(chainName, label).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeRPCError(w, http.StatusTooManyRequests, rpcErrLimitExceeded, "rate limit exceeded, retry in "+wait.Round(time.Millisecond).String())
+	return false
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/health"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// readyChains are the chains which need a routable endpoint for the
+	// replica to be ready. Other chains without one are reported as degraded.
+	readyChains []string
+
+	errNoChains = errors.New("no chains configured")
+)
+
+// EndpointHealth is the health of one endpoint of a chain. Endpoint is the
+// host only, since endpoint URLs can carry provider API keys.
+type EndpointHealth struct {
+	Endpoint      string     `json:"endpoint"`
+	Enabled       bool       `json:"enabled"`
+	Failover      bool       `json:"failover"`
+	ReadOnly      bool       `json:"readOnly"`
+	Routable      bool       `json:"routable"`
+	Connected     bool       `json:"connected"`
+	Healthy       bool       `json:"healthy"`
+	Error         string     `json:"error,omitempty"`
+	LastProbe     *time.Time `json:"lastProbe,omitempty"`
+	CooldownUntil *time.Time `json:"cooldownUntil,omitempty"`
+	BlockHead     uint64     `json:"blockHead"`
+	Lag           uint64     `json:"lag"`
+}
+
+// ChainHealth is the health of a chain and its endpoints.
+type ChainHealth struct {
+	Chain     string            `json:"chain"`
+	Required  bool              `json:"required"`
+	Ready     bool              `json:"ready"`
+	Head      uint64            `json:"head"`
+	Endpoints []*EndpointHealth `json:"endpoints"`
+}
+
+// HealthReport is the readiness of the replica and the health of each
+// chain. Checks are the failing readiness checks, and Degraded the failing
+// components ethlb keeps serving without.
+type HealthReport struct {
+	Ready    bool              `json:"ready"`
+	Checks   map[string]string `json:"checks,omitempty"`
+	Degraded map[string]string `json:"degraded,omitempty"`
+	Chains   []*ChainHealth    `json:"chains"`
+}
+
+// ConfigReadiness registers the readiness checks for the loaded config and
+// the chains listed in READY_REQUIRED_CHAINS. Every other chain is checked
+// without failing readiness, so one unhealthy chain does not take every
+// replica out of rotation.
+func ConfigReadiness() error {
+	l := log.WithFields(log.Fields{
+		"action": "ConfigReadiness",
+	})
+	l.Debug("start")
+	readyChains = nil
+	for _, c := range strings.Split(os.Getenv("READY_REQUIRED_CHAINS"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			readyChains = append(readyChains, c)
+		}
+	}
+	health.RegisterReadiness("config", func() error {
+		if len(Chains) == 0 {
+			return errNoChains
+		}
+		return nil
+	})
+	health.RegisterReadiness("chains", checkChainsReady)
+	health.Register("chains", checkChainsDegraded)
+	return nil
+}
+
+func chainRequired(name string) bool {
+	for _, c := range readyChains {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// healthy reports whether requests can be routed to the endpoint and its
+// last block head probe succeeded.
+func (e *ChainEndpoint) healthy() bool {
+	return e.Client != nil && e.probeErr == nil
+}
+
+// ready reports whether the chain has a routable, healthy endpoint.
+func (c *chain) ready() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.routable(time.Now()) {
+		if e.healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkChainsReady fails if a required chain has no healthy endpoint
+// requests could be routed to, or is missing from the config.
+func checkChainsReady() error {
+	var unready []string
+	seen := make(map[string]bool)
+	for _, c := range Chains {
+		seen[c.Name] = true
+		if chainRequired(c.Name) && !c.ready() {
+			unready = append(unready, c.Name)
+		}
+	}
+	for _, c := range readyChains {
+		if !seen[c] {
+			unready = append(unready, c)
+		}
+	}
+	if len(unready) > 0 {
+		sort.Strings(unready)
+		return fmt.Errorf("no healthy endpoints for chains %s", strings.Join(unready, ", "))
+	}
+	return nil
+}
+
+// checkChainsDegraded fails if a chain which is not required for readiness
+// has no healthy endpoint requests could be routed to.
+func checkChainsDegraded() error {
+	var unready []string
+	for _, c := range Chains {
+		if !chainRequired(c.Name) && !c.ready() {
+			unready = append(unready, c.Name)
+		}
+	}
+	if len(unready) > 0 {
+		sort.Strings(unready)
+		return fmt.Errorf("no healthy endpoints for chains %s", strings.Join(unready, ", "))
+	}
+	return nil
+}
+
+func (c *chain) health() *ChainHealth {
+	ch := &ChainHealth{
+		Chain:    c.Name,
+		Required: chainRequired(c.Name),
+		Head:     c.head(),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	routable := make(map[*ChainEndpoint]bool)
+	for _, e := range c.routable(time.Now()) {
+		routable[e] = true
+	}
+	for _, e := range c.Endpoints {
+		eh := &EndpointHealth{
+			Endpoint:  endpointHost(e.Endpoint),
+			Enabled:   e.Enabled,
+			Failover:  e.Failover,
+			ReadOnly:  e.ReadOnly,
+			Routable:  routable[e],
+			Connected: e.Client != nil,
+			Healthy:   e.healthy(),
+			BlockHead: e.BlockHead,
+		}
+		if e.probeErr != nil {
+			// client errors can quote the full endpoint URL
+			eh.Error = strings.ReplaceAll(e.probeErr.Error(), e.Endpoint, eh.Endpoint)
+		}
+		if !e.lastProbe.IsZero() {
+			lp := e.lastProbe
+			eh.LastProbe = &lp
+		}
+		if eh.Routable && eh.Healthy {
+			ch.Ready = true
+		}
+		if !e.CooldownUntil.IsZero() {
+			cu := e.CooldownUntil
+			eh.CooldownUntil = &cu
+		}
+		if ch.Head > e.BlockHead {
+			eh.Lag = ch.Head - e.BlockHead
+		}
+		ch.Endpoints = append(ch.Endpoints, eh)
+	}
+	return ch
+}
+
+// HealthReportHandler reports readiness checks and the health of each
+// chain and endpoint as JSON, with status 503 when not ready.
+func HealthReportHandler(w http.ResponseWriter, r *http.Request) {
+	rep := &HealthReport{
+		Checks:   make(map[string]string),
+		Degraded: make(map[string]string),
+		Chains:   []*ChainHealth{},
+	}
+	failed := health.Readiness()
+	rep.Ready = len(failed) == 0
+	for n, err := range failed {
+		rep.Checks[n] = err.Error()
+	}
+	for n, err := range health.Status() {
+		rep.Degraded[n] = err.Error()
+	}
+	for _, c := range Chains {
+		rep.Chains = append(rep.Chains, c.health())
+	}
+	status := http.StatusOK
+	if !rep.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, rep)
+}
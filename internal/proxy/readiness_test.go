@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+func TestChainReadiness(t *testing.T) {
+	prevChains, prevReady := Chains, readyChains
+	defer func() { Chains, readyChains = prevChains, prevReady }()
+	client := ethclient.NewClient(nil)
+	healthy := func() *ChainEndpoint {
+		return &ChainEndpoint{Endpoint: "https://up.example/v3/s3cret", Enabled: true, Client: client, BlockHead: 100}
+	}
+	failing := func() *ChainEndpoint {
+		return &ChainEndpoint{
+			Endpoint: "https://down.example/v3/s3cret",
+			Enabled:  true,
+			Client:   client,
+			probeErr: errors.New(`Post "https://down.example/v3/s3cret": connection refused`),
+		}
+	}
+	cooling := func() *ChainEndpoint {
+		e := healthy()
+		e.Enabled = false
+		e.CooldownUntil = time.Now().Add(time.Minute)
+		return e
+	}
+	tests := []struct {
+		name         string
+		endpoints    []*ChainEndpoint
+		required     bool
+		wantReady    bool
+		wantDegraded bool
+	}{
+		{
+			name:      "healthy endpoint",
+			endpoints: []*ChainEndpoint{healthy(), failing()},
+			required:  true,
+			wantReady: true,
+		},
+		{
+			name:      "required chain without a healthy endpoint",
+			endpoints: []*ChainEndpoint{failing()},
+			required:  true,
+		},
+		{
+			name:         "optional chain without a healthy endpoint",
+			endpoints:    []*ChainEndpoint{failing()},
+			wantReady:    true,
+			wantDegraded: true,
+		},
+		{
+			name:      "healthy endpoint in cooldown",
+			endpoints: []*ChainEndpoint{cooling(), failing()},
+			required:  true,
+		},
+		{
+			name:         "disconnected endpoint",
+			endpoints:    []*ChainEndpoint{{Endpoint: "https://up.example", Enabled: true}, failing()},
+			wantReady:    true,
+			wantDegraded: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Chains = []*chain{{Name: "ethereum", Endpoints: tt.endpoints}}
+			readyChains = nil
+			if tt.required {
+				readyChains = []string{"ethereum"}
+			}
+			before := *tt.endpoints[0]
+			if err := checkChainsReady(); (err == nil) != tt.wantReady {
+				t.Errorf("checkChainsReady() = %v, want ready %v", err, tt.wantReady)
+			}
+			if err := checkChainsDegraded(); (err != nil) != tt.wantDegraded {
+				t.Errorf("checkChainsDegraded() = %v, want degraded %v", err, tt.wantDegraded)
+			}
+			if e := tt.endpoints[0]; e.Enabled != before.Enabled || e.CooldownUntil != before.CooldownUntil {
+				t.Error("readiness checks changed the endpoint state")
+			}
+		})
+	}
+}
+
+func TestMissingRequiredChain(t *testing.T) {
+	prevChains, prevReady := Chains, readyChains
+	defer func() { Chains, readyChains = prevChains, prevReady }()
+	Chains = []*chain{{Name: "ethereum"}}
+	readyChains = []string{"polygon"}
+	if err := checkChainsReady(); err == nil {
+		t.Error("checkChainsReady() passed without the required chain")
+	}
+}
+
+func TestHealthReportRedactsEndpoints(t *testing.T) {
+	prevChains, prevReady := Chains, readyChains
+	defer func() { Chains, readyChains = prevChains, prevReady }()
+	readyChains = nil
+	Chains = []*chain{{Name: "ethereum", Endpoints: []*ChainEndpoint{{
+		Endpoint: "https://down.example/v3/s3cret",
+		Enabled:  true,
+		Client:   ethclient.NewClient(nil),
+		probeErr: errors.New(`Post "https://down.example/v3/s3cret": connection refused`),
+	}}}}
+	w := httptest.NewRecorder()
+	HealthReportHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK && w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d", w.Code)
+	}
+	rep := &HealthReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), rep); err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Chains) != 1 || len(rep.Chains[0].Endpoints) != 1 {
+		t.Fatalf("report = %s, want one chain and endpoint", w.Body)
+	}
+	eh := rep.Chains[0].Endpoints[0]
+	if eh.Endpoint != "down.example" || eh.Healthy || rep.Chains[0].Ready {
+		t.Errorf("endpoint health = %+v, want an unhealthy down.example", eh)
+	}
+	if want := `Post "down.example": connection refused`; eh.Error != want {
+		t.Errorf("endpoint error = %q, want %q", eh.Error, want)
+	}
+}
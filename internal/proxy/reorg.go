@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/cache"
+	"github.com/robertlestak/ethlb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// reorgTrackDepth is the number of recent block hashes kept per chain.
+	// Reorgs deeper than this are not detected. 0 disables tracking.
+	reorgTrackDepth uint64 = 64
+
+	chainHashesMu sync.Mutex
+	chainHashes   = make(map[string]*blockHashes)
+)
+
+// blockHashes is the recent canonical chain as seen by ethlb.
+type blockHashes struct {
+	mu     sync.Mutex
+	hashes map[uint64]string
+}
+
+type blockHeader struct {
+	Number     string `json:"number"`
+	Hash       string `json:"hash"`
+	ParentHash string `json:"parentHash"`
+}
+
+func ConfigReorgTracking() error {
+	l := log.WithFields(log.Fields{
+		"action": "ConfigReorgTracking",
+	})
+	l.Debug("start")
+	if os.Getenv("REORG_TRACK_DEPTH") != "" {
+		var err error
+		reorgTrackDepth, err = strconv.ParseUint(os.Getenv("REORG_TRACK_DEPTH"), 10, 64)
+		if err != nil {
+			l.WithError(err).Error("failed to parse REORG_TRACK_DEPTH")
+			return err
+		}
+	}
+	return nil
+}
+
+func hashesFor(chainName string) *blockHashes {
+	chainHashesMu.Lock()
+	defer chainHashesMu.Unlock()
+	bh, ok := chainHashes[chainName]
+	if !ok {
+		bh = &blockHashes{hashes: make(map[uint64]string)}
+		chainHashes[chainName] = bh
+	}
+	return bh
+}
+
+func (bh *blockHashes) prune(head uint64) {
+	for h := range bh.hashes {
+		if h+reorgTrackDepth <= head || h > head {
+			delete(bh.hashes, h)
+		}
+	}
+}
+
+func fetchHeader(ctx context.Context, e *ChainEndpoint, n uint64) (*blockHeader, error) {
+	if e.rpcClient == nil {
+		return nil, errors.New("endpoint with no client")
+	}
+	// use the hashes reported by the node rather than hashing the header
+	// locally, which depends on knowing every header field of the chain
+	h := &blockHeader{}
+	if err := e.rpcClient.CallContext(ctx, h, "eth_getBlockByNumber", fmt.Sprintf("0x%x", n), false); err != nil {
+		return nil, err
+	}
+	if h.Hash == "" {
+		return nil, fmt.Errorf("block %d not found", n)
+	}
+	return h, nil
+}
+
+// checkReorg records the hash of the chain head and walks back through
+// recently seen heights whose hashes no longer match, which indicates a
+// reorg. Cache entries tied to replaced heights are invalidated.
+func (c *chain) checkReorg(ctx context.Context) error {
+	if reorgTrackDepth == 0 {
+		return nil
+	}
+	l := log.WithFields(log.Fields{
+		"chain":  c.Name,
+		"action": "checkReorg",
+	})
+	l.Debug("start")
+	var best *ChainEndpoint
+	var head uint64
+	c.mu.Lock()
+	for _, e := range c.Endpoints {
+		if e.Enabled && e.rpcClient != nil && (best == nil || e.BlockHead > head) {
+			best = e
+			head = e.BlockHead
+		}
+	}
+	c.mu.Unlock()
+	if best == nil || head == 0 {
+		return nil
+	}
+	bh := hashesFor(c.Name)
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	cur, err := fetchHeader(ctx, best, head)
+	if err != nil {
+		return err
+	}
+	var reorged []uint64
+	for n := head; ; n-- {
+		old, seen := bh.hashes[n]
+		if seen && old == cur.Hash {
+			break
+		}
+		if seen {
+			reorged = append(reorged, n)
+		}
+		bh.hashes[n] = cur.Hash
+		if n == 0 || head-n+1 >= reorgTrackDepth {
+			break
+		}
+		parent, pseen := bh.hashes[n-1]
+		if pseen && parent == cur.ParentHash {
+			break
+		}
+		// keep walking while the parent differs from what we saw, filling
+		// in heights produced between probes, up to the tracking depth
+		if cur, err = fetchHeader(ctx, best, n-1); err != nil {
+			return err
+		}
+	}
+	bh.prune(head)
+	if len(reorged) == 0 {
+		return nil
+	}
+	depth := reorged[0] - reorged[len(reorged)-1] + 1
+	l.WithFields(log.Fields{
+		"depth": depth,
+		"from":  reorged[len(reorged)-1],
+		"to":    reorged[0],
+	}).Warn("chain reorg detected")
+	metrics.ReorgDepth.WithLabelValues(c.Name).Observe(float64(depth))
+	invalidateBlocks(c.Name, reorged)
+	return nil
+}
+
+func blockIndexName(chainName string, n uint64) string {
+	return chainName + ":block:" + strconv.FormatUint(n, 10)
+}
+
+// indexCacheEntry ties a cache entry to the block heights its response
+// depends on so it can be invalidated if any of them is reorged.
+func indexCacheEntry(chainName string, cacheKey string, rr *rpcRequest, body []byte, head uint64, exp time.Duration) {
+	l := log.WithFields(log.Fields{
+		"chain":  chainName,
+		"action": "indexCacheEntry",
+		"cache":  cacheKey,
+	})
+	if reorgTrackDepth == 0 {
+		return
+	}
+	results := rr.results(body)
+	seen := make(map[uint64]bool)
+	for i, c := range rr.Calls {
+		var res json.RawMessage
+		if i < len(results) {
+			res = results[i]
+		}
+		for _, n := range c.blockHeights(res, head) {
+			// blocks this far behind the head are not tracked for reorgs
+			if seen[n] || n+reorgTrackDepth <= head {
+				continue
+			}
+			seen[n] = true
+			if err := cache.AddToIndex(blockIndexName(chainName, n), cacheKey, exp); err != nil {
+				l.WithError(err).Error("failed to index cache entry")
+			}
+		}
+	}
+}
+
+// invalidateBlocks removes all cache entries tied to the given heights.
+func invalidateBlocks(chainName string, heights []uint64) int {
+	l := log.WithFields(log.Fields{
+		"chain":  chainName,
+		"action": "invalidateBlocks",
+	})
+	var removed int
+	for _, n := range heights {
+		idx := blockIndexName(chainName, n)
+		keys, err := cache.IndexMembers(idx)
+		if err != nil {
+			l.WithError(err).WithField("block", n).Error("failed to get cache index")
+			continue
+		}
+		if err := cache.Del(keys...); err != nil {
+			l.WithError(err).WithField("block", n).Error("failed to invalidate cache entries")
+			continue
+		}
+		if err := cache.DelIndex(idx); err != nil {
+			l.WithError(err).WithField("block", n).Error("failed to delete cache index")
+		}
+		removed += len(keys)
+	}
+	l.WithField("entries", removed).Debug("invalidated cache entries")
+	return removed
+}
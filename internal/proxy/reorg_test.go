@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/cache"
+)
+
+func TestCheckReorgInvalidatesReplacedBlocks(t *testing.T) {
+	defer func(depth uint64) { reorgTrackDepth = depth }(reorgTrackDepth)
+	reorgTrackDepth = 8
+	node := newFakeNode(t, 100)
+	useTestChains(t, `[{"name":"reorg","endpoints":[{"endpoint":"`+node.URL+`","enabled":true}]}]`)
+	defer func() {
+		chainHashesMu.Lock()
+		delete(chainHashes, "reorg")
+		chainHashesMu.Unlock()
+	}()
+	c := Chains[0]
+	ctx := context.Background()
+	if err := c.UpdateEndpointBlockHead(ctx); err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[uint64]string)
+	for _, b := range []uint64{90, 98, 99, 100} {
+		params := fmt.Sprintf(`["0x%x",false]`, b)
+		rr := mustParseRPCRequest(t, `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":`+params+`}`)
+		keys[b] = blockCacheKey(t, c.Name, "eth_getBlockByNumber", params)
+		if err := cache.Set(keys[b], "v", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		body := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":{"number":"0x%x"}}`, b)
+		indexCacheEntry(c.Name, keys[b], rr, []byte(body), 100, time.Minute)
+	}
+
+	// a new block on the same chain invalidates nothing
+	node.setHead(101)
+	if err := c.UpdateEndpointBlockHead(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for b, k := range keys {
+		if v, _ := cache.Get(k); v == "" {
+			t.Fatalf("block %d invalidated without a reorg", b)
+		}
+	}
+
+	node.reorg(99)
+	if err := c.UpdateEndpointBlockHead(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for b, want := range map[uint64]bool{90: true, 98: true, 99: false, 100: false} {
+		v, _ := cache.Get(keys[b])
+		if got := v != ""; got != want {
+			t.Errorf("block %d cached = %v, want %v", b, got, want)
+		}
+	}
+	bh := hashesFor(c.Name)
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	if bh.hashes[100] != node.hash(100) {
+		t.Errorf("tracked hash of block 100 = %s, want the reorged %s", bh.hashes[100], node.hash(100))
+	}
+}
+
+func TestInvalidateBlocks(t *testing.T) {
+	useTestChains(t, `[{"name":"ethereum","endpoints":[]}]`)
+	for _, k := range []string{"ethereum:a", "ethereum:b", "ethereum:c"} {
+		if err := cache.Set(k, "v", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// entries may depend on more than one block
+	for b, ks := range map[uint64][]string{
+		10: {"ethereum:a", "ethereum:b"},
+		11: {"ethereum:b"},
+		12: {"ethereum:c"},
+	} {
+		for _, k := range ks {
+			if err := cache.AddToIndex(blockIndexName("ethereum", b), k, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if n := invalidateBlocks("ethereum", []uint64{10, 11}); n != 3 {
+		t.Errorf("invalidateBlocks() = %d, want 3", n)
+	}
+	for k, want := range map[string]bool{"ethereum:a": false, "ethereum:b": false, "ethereum:c": true} {
+		v, _ := cache.Get(k)
+		if got := v != ""; got != want {
+			t.Errorf("%s cached = %v, want %v", k, got, want)
+		}
+	}
+	if members, _ := cache.IndexMembers(blockIndexName("ethereum", 10)); len(members) != 0 {
+		t.Errorf("index of block 10 = %v, want it removed", members)
+	}
+}
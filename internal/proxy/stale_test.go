@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/cache"
+)
+
+const staleBlockRequest = `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x10",false]}`
+
+// setStaleEntry caches an old response for staleBlockRequest which went
+// stale age ago.
+func setStaleEntry(t *testing.T, chainName string, age time.Duration, hard time.Duration) string {
+	t.Helper()
+	key := blockCacheKey(t, chainName, "eth_getBlockByNumber", `["0x10",false]`)
+	now := time.Now()
+	e := &cache.Entry{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       []byte(`{"jsonrpc":"2.0","id":1,"result":{"number":"0x10","hash":"0xold"}}`),
+		CreatedAt:  now.Add(-age - time.Minute),
+		SoftExpiry: now.Add(-age),
+		HardExpiry: now.Add(-age + hard),
+	}
+	cd, err := e.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set(key, cd, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// roundTripBlock sends staleBlockRequest through the chain's transport.
+func roundTripBlock(t *testing.T, c *chain) (*http.Response, string, error) {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/"+c.Name, bytes.NewBufferString(staleBlockRequest))
+	req.RequestURI = ""
+	setEndpointURL(req, c.Endpoints[0])
+	tr := &transport{chain: c.Name, endpoint: c.Endpoints[0]}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b), nil
+}
+
+func TestServeStale(t *testing.T) {
+	defer func(stale, staleIfError, delay time.Duration, retries int) {
+		cacheStaleTTL, cacheStaleIfErrorTTL, retryDelay, maxRetries = stale, staleIfError, delay, retries
+	}(cacheStaleTTL, cacheStaleIfErrorTTL, retryDelay, maxRetries)
+	cacheStaleTTL = time.Minute
+	cacheStaleIfErrorTTL = time.Hour
+	retryDelay = time.Millisecond
+	maxRetries = 2
+	tests := []struct {
+		name      string
+		age       time.Duration
+		failing   bool
+		wantCache string
+		wantOld   bool
+		wantErr   bool
+	}{
+		{
+			name:      "stale while refreshing",
+			age:       time.Second,
+			wantCache: "stale",
+			wantOld:   true,
+		},
+		{
+			name:      "past the stale ttl",
+			age:       2 * time.Minute,
+			wantCache: "miss",
+		},
+		{
+			name:      "stale if error",
+			age:       2 * time.Minute,
+			failing:   true,
+			wantCache: "stale",
+			wantOld:   true,
+		},
+		{
+			name:    "past the hard expiry",
+			age:     2 * time.Hour,
+			failing: true,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newFakeNode(t, 100)
+			useTestChains(t, `[{"name":"stale","endpoints":[{"endpoint":"`+node.URL+`","enabled":true}]}]`)
+			c := Chains[0]
+			key := setStaleEntry(t, c.Name, tt.age, cacheStaleIfErrorTTL)
+			node.setFailing(tt.failing)
+			resp, body, err := roundTripBlock(t, c)
+			if tt.wantErr {
+				if err == nil && resp.StatusCode == http.StatusOK {
+					t.Fatalf("served %s past its hard expiry", body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Header.Get("x-ethlb-cache"); got != tt.wantCache {
+				t.Errorf("x-ethlb-cache = %s, want %s", got, tt.wantCache)
+			}
+			if old := strings.Contains(body, "0xold"); old != tt.wantOld {
+				t.Errorf("response %s, want the stale entry %v", body, tt.wantOld)
+			}
+			workers.Wait()
+			if tt.failing {
+				return
+			}
+			// the entry is replaced with the upstream response either way
+			cd, err := cache.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, err := cache.DecodeEntry(cd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(e.Body, []byte("0xold")) || e.Stale(time.Now()) {
+				t.Errorf("cache entry %s was not refreshed", e.Body)
+			}
+			if n := node.callCount("eth_getBlockByNumber"); n != 1 {
+				t.Errorf("eth_getBlockByNumber called %d times, want 1", n)
+			}
+		})
+	}
+}
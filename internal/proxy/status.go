@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	_ "embed"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/health"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// latencyWeight is the weight of each response in an endpoint's
+	// average latency
+	latencyWeight = 0.2
+)
+
+//go:embed status.html
+var statusPage []byte
+
+// latencyTracker keeps a moving average of an endpoint's response times.
+type latencyTracker struct {
+	mu   sync.Mutex
+	avg  time.Duration
+	last time.Duration
+	at   time.Time
+}
+
+func (t *latencyTracker) observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.at.IsZero() {
+		t.avg = d
+	} else {
+		t.avg += time.Duration(latencyWeight * float64(d-t.avg))
+	}
+	t.last = d
+	t.at = time.Now()
+}
+
+func (t *latencyTracker) get() (avg, last time.Duration, at time.Time) {
+	if t == nil {
+		return 0, 0, time.Time{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.avg, t.last, t.at
+}
+
+// EndpointStatus is the live routing state of an endpoint.
+type EndpointStatus struct {
+	*EndpointHealth
+	Circuit       string `json:"circuit"`
+	Inflight      int32  `json:"inflight"`
+	MaxConcurrent int    `json:"maxConcurrent,omitempty"`
+	// LatencySeconds is a moving average of recent response times, and
+	// LastLatencySeconds the time of the last response at LastResponse
+	LatencySeconds     float64    `json:"latencySeconds"`
+	LastLatencySeconds float64    `json:"lastLatencySeconds"`
+	LastResponse       *time.Time `json:"lastResponse,omitempty"`
+}
+
+// ChainStatus is the live routing state of a chain and its endpoints.
+type ChainStatus struct {
+	Chain     string            `json:"chain"`
+	Ready     bool              `json:"ready"`
+	Head      uint64            `json:"head"`
+	Endpoints []*EndpointStatus `json:"endpoints"`
+}
+
+// Status is the live state of the endpoint pool of each chain.
+type Status struct {
+	Time         time.Time      `json:"time"`
+	Ready        bool           `json:"ready"`
+	ShuttingDown bool           `json:"shuttingDown"`
+	Chains       []*ChainStatus `json:"chains"`
+}
+
+func (c *chain) status() *ChainStatus {
+	ch := c.health()
+	cs := &ChainStatus{
+		Chain: ch.Chain,
+		Ready: ch.Ready,
+		Head:  ch.Head,
+	}
+	for i, e := range c.Endpoints {
+		es := &EndpointStatus{
+			EndpointHealth: ch.Endpoints[i],
+			Circuit:        e.CircuitState(),
+			Inflight:       e.Inflight(),
+			MaxConcurrent:  e.MaxConcurrent,
+		}
+		avg, last, at := e.latency.get()
+		if !at.IsZero() {
+			es.LatencySeconds = avg.Seconds()
+			es.LastLatencySeconds = last.Seconds()
+			es.LastResponse = &at
+		}
+		cs.Endpoints = append(cs.Endpoints, es)
+	}
+	return cs
+}
+
+// StatusHandler reports the live state of every chain and endpoint as JSON,
+// optionally for a single chain.
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"action": "StatusHandler",
+	})
+	l.Debug("start")
+	defer l.Debug("end")
+	st := &Status{
+		Time:         time.Now(),
+		Ready:        len(health.Readiness()) == 0,
+		ShuttingDown: health.ShuttingDown(),
+		Chains:       []*ChainStatus{},
+	}
+	name := r.URL.Query().Get("chain")
+	for _, c := range Chains {
+		if name != "" && name != c.Name {
+			continue
+		}
+		st.Chains = append(st.Chains, c.status())
+	}
+	if name != "" && len(st.Chains) == 0 {
+		writeAdminError(w, http.StatusNotFound, errors.New("no such chain"))
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// StatusPageHandler serves a page rendering the /status report.
+func StatusPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write(statusPage); err != nil {
+		log.WithError(err).Error("failed to write status page")
+	}
+}
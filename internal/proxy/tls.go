@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	log "github.com/sirupsen/logrus"
+)
+
+// endpointTLSConfig configures TLS to an endpoint. Certificates are verified
+// against the system roots unless a CA bundle is given, and are only skipped
+// with InsecureSkipVerify.
+type endpointTLSConfig struct {
+	// CAFile is a PEM bundle of the CAs trusted for the endpoint, in place
+	// of the system roots
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile are a PEM client certificate and key for mTLS
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// ServerName overrides the name sent with SNI and verified against the
+	// endpoint's certificate
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// buildTLSConfig loads the endpoint's TLS settings. Files are read when the
+// config is loaded, and the settings and file contents are summed so
+// rotated certificates are picked up on the next config reload.
+func (e *ChainEndpoint) buildTLSConfig() error {
+	l := log.WithFields(log.Fields{
+		"action":   "buildTLSConfig",
+		"endpoint": endpointHost(e.Endpoint),
+	})
+	c := &tls.Config{}
+	if e.TLS == nil {
+		e.tlsConfig = c
+		return nil
+	}
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%+v", *e.TLS)
+	c.ServerName = e.TLS.ServerName
+	if e.TLS.InsecureSkipVerify {
+		l.Warn("tls certificate verification disabled")
+		c.InsecureSkipVerify = true
+	}
+	if e.TLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(e.TLS.CAFile)
+		if err != nil {
+			l.WithError(err).Error("failed to read ca file")
+			return err
+		}
+		sum.Write(pem)
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			l.WithField("caFile", e.TLS.CAFile).Error("no certificates in ca file")
+			return errors.New("no certificates in ca file " + e.TLS.CAFile)
+		}
+	}
+	if e.TLS.CertFile != "" || e.TLS.KeyFile != "" {
+		if e.TLS.CertFile == "" || e.TLS.KeyFile == "" {
+			l.Error("tls certFile and keyFile must be set together")
+			return errors.New("tls certFile and keyFile must be set together")
+		}
+		certPEM, err := ioutil.ReadFile(e.TLS.CertFile)
+		if err != nil {
+			l.WithError(err).Error("failed to read client certificate")
+			return err
+		}
+		keyPEM, err := ioutil.ReadFile(e.TLS.KeyFile)
+		if err != nil {
+			l.WithError(err).Error("failed to read client key")
+			return err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			l.WithError(err).Error("failed to load client certificate")
+			return err
+		}
+		c.Certificates = []tls.Certificate{cert}
+		sum.Write(certPEM)
+		sum.Write(keyPEM)
+	}
+	e.tlsConfig = c
+	copy(e.tlsSum[:], sum.Sum(nil))
+	return nil
+}
+
+// dialRPC connects the endpoint's RPC client, using its TLS config for
+// HTTP endpoints.
+func (e *ChainEndpoint) dialRPC() (*rpc.Client, error) {
+	u, err := url.Parse(e.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return rpc.Dial(e.Endpoint)
+	}
+	return rpc.DialHTTPWithClient(e.Endpoint, &http.Client{
+		Transport: e.transport,
+	})
+}
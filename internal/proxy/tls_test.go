@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePEM writes a block of the given type to a file in dir.
+func writePEM(t *testing.T, dir string, name string, typ string, der []byte) string {
+	t.Helper()
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// writeClientCert writes a self-signed client certificate and its key.
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ethlb"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func TestEndpointTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("mtls") != "" && len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	dir := t.TempDir()
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	certFile, keyFile := writeClientCert(t, dir)
+	tests := []struct {
+		name     string
+		tls      *endpointTLSConfig
+		query    string
+		wantErr  bool
+		wantCode int
+	}{
+		{
+			name:    "verified against the system roots by default",
+			wantErr: true,
+		},
+		{
+			name:     "ca file",
+			tls:      &endpointTLSConfig{CAFile: caFile},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:    "server name must match the certificate",
+			tls:     &endpointTLSConfig{CAFile: caFile, ServerName: "node.example"},
+			wantErr: true,
+		},
+		{
+			name:     "server name",
+			tls:      &endpointTLSConfig{CAFile: caFile, ServerName: "example.com"},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "insecure skip verify",
+			tls:      &endpointTLSConfig{InsecureSkipVerify: true},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "no client certificate",
+			tls:      &endpointTLSConfig{CAFile: caFile},
+			query:    "?mtls=1",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "client certificate",
+			tls:      &endpointTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile},
+			query:    "?mtls=1",
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ChainEndpoint{Endpoint: srv.URL, TLS: tt.tls, latency: &latencyTracker{}}
+			if err := e.buildTLSConfig(); err != nil {
+				t.Fatal(err)
+			}
+			e.buildTransport("tls")
+			defer e.closeIdle()
+			resp, err := (&http.Client{Transport: e.transport}).Get(srv.URL + tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("request error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestBuildTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	certFile, _ := writeClientCert(t, dir)
+	tests := []struct {
+		name string
+		tls  *endpointTLSConfig
+	}{
+		{"missing ca file", &endpointTLSConfig{CAFile: filepath.Join(dir, "missing.pem")}},
+		{"no certificates in ca file", &endpointTLSConfig{CAFile: empty}},
+		{"cert without key", &endpointTLSConfig{CertFile: certFile}},
+		{"key does not match", &endpointTLSConfig{CertFile: certFile, KeyFile: certFile}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &ChainEndpoint{Endpoint: "https://node.example", TLS: tt.tls}
+			if err := e.buildTLSConfig(); err == nil {
+				t.Error("buildTLSConfig() succeeded")
+			}
+		})
+	}
+}
+
+func TestBuildTLSConfigSumsFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeClientCert(t, dir)
+	e := &ChainEndpoint{TLS: &endpointTLSConfig{CertFile: certFile, KeyFile: keyFile}}
+	if err := e.buildTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	before := e.tlsSum
+	// a rotated certificate changes the sum so the endpoint is rebuilt
+	writeClientCert(t, dir)
+	if err := e.buildTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if e.tlsSum == before {
+		t.Error("sum unchanged after the certificate was rotated")
+	}
+}
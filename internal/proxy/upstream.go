@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// upstream transport settings, shared by all endpoints
+	upstreamDialTimeout           = 30 * time.Second
+	upstreamKeepAlive             = 30 * time.Second
+	upstreamTLSHandshakeTimeout   = 10 * time.Second
+	upstreamResponseHeaderTimeout time.Duration
+	upstreamIdleConnTimeout       = 90 * time.Second
+	upstreamMaxIdleConnsPerHost   = 10000
+	upstreamMaxConnsPerHost       int
+	upstreamHTTP2                 = true
+)
+
+func ConfigUpstreamTransport() error {
+	l := log.WithFields(log.Fields{
+		"action": "ConfigUpstreamTransport",
+	})
+	l.Debug("start")
+	durations := map[string]*time.Duration{
+		"UPSTREAM_DIAL_TIMEOUT":            &upstreamDialTimeout,
+		"UPSTREAM_KEEPALIVE":               &upstreamKeepAlive,
+		"UPSTREAM_TLS_HANDSHAKE_TIMEOUT":   &upstreamTLSHandshakeTimeout,
+		"UPSTREAM_RESPONSE_HEADER_TIMEOUT": &upstreamResponseHeaderTimeout,
+		"UPSTREAM_IDLE_CONN_TIMEOUT":       &upstreamIdleConnTimeout,
+	}
+	for k, d := range durations {
+		if os.Getenv(k) == "" {
+			continue
+		}
+		v, err := time.ParseDuration(os.Getenv(k))
+		if err != nil {
+			l.WithError(err).Errorf("failed to parse %s", k)
+			return err
+		}
+		*d = v
+	}
+	ints := map[string]*int{
+		"UPSTREAM_MAX_IDLE_CONNS_PER_HOST": &upstreamMaxIdleConnsPerHost,
+		"UPSTREAM_MAX_CONNS_PER_HOST":      &upstreamMaxConnsPerHost,
+	}
+	for k, n := range ints {
+		if os.Getenv(k) == "" {
+			continue
+		}
+		v, err := strconv.Atoi(os.Getenv(k))
+		if err != nil {
+			l.WithError(err).Errorf("failed to parse %s", k)
+			return err
+		}
+		*n = v
+	}
+	if os.Getenv("UPSTREAM_HTTP2") != "" {
+		v, err := strconv.ParseBool(os.Getenv("UPSTREAM_HTTP2"))
+		if err != nil {
+			l.WithError(err).Error("failed to parse UPSTREAM_HTTP2")
+			return err
+		}
+		upstreamHTTP2 = v
+	}
+	return nil
+}
+
+// tracedTransport records connection reuse and setup time, and the
+// response time of requests to an endpoint.
+type tracedTransport struct {
+	http.RoundTripper
+	chain    string
+	endpoint string
+	latency  *latencyTracker
+}
+
+func (t *tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var dnsStart, connectStart, tlsStart time.Time
+	observe := func(phase string, start time.Time) {
+		if start.IsZero() {
+			return
+		}
+		metrics.UpstreamConnectDuration.WithLabelValues(t.chain, t.endpoint, phase).Observe(time.Since(start).Seconds())
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { observe("dns", dnsStart) },
+		ConnectStart:      func(string, string) { connectStart = time.Now() },
+		ConnectDone:       func(string, string, error) { observe("connect", connectStart) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { observe("tls", tlsStart) },
+		GotConn: func(i httptrace.GotConnInfo) {
+			metrics.UpstreamConnections.WithLabelValues(t.chain, t.endpoint, strconv.FormatBool(i.Reused)).Inc()
+		},
+	}
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil {
+		d := time.Since(start)
+		metrics.UpstreamRequestDuration.WithLabelValues(t.chain, t.endpoint).Observe(d.Seconds())
+		t.latency.observe(d)
+	}
+	return resp, err
+}
+
+// buildTransport creates the endpoint's transport, with its TLS settings and
+// credentials. The transport is kept for the life of the endpoint so its
+// connections are pooled across requests.
+func (e *ChainEndpoint) buildTransport(chainName string) {
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	tc := &tls.Config{}
+	if e.tlsConfig != nil {
+		tc = e.tlsConfig.Clone()
+	}
+	t := &http.Transport{
+		Proxy: defaultTransport.Proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   upstreamDialTimeout,
+			KeepAlive: upstreamKeepAlive,
+		}).DialContext,
+		ForceAttemptHTTP2:     upstreamHTTP2,
+		MaxIdleConns:          10000,
+		MaxIdleConnsPerHost:   upstreamMaxIdleConnsPerHost,
+		MaxConnsPerHost:       upstreamMaxConnsPerHost,
+		IdleConnTimeout:       upstreamIdleConnTimeout,
+		ExpectContinueTimeout: defaultTransport.ExpectContinueTimeout,
+		TLSHandshakeTimeout:   upstreamTLSHandshakeTimeout,
+		ResponseHeaderTimeout: upstreamResponseHeaderTimeout,
+		TLSClientConfig:       tc,
+	}
+	if !upstreamHTTP2 {
+		// a non-nil map disables the automatic HTTP/2 upgrade
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	e.conns = t
+	var rt http.RoundTripper = &tracedTransport{
+		RoundTripper: t,
+		chain:        chainName,
+		endpoint:     endpointLabel(e.Endpoint),
+		latency:      e.latency,
+	}
+	if e.Auth != nil {
+		rt = &authTransport{
+			RoundTripper: rt,
+			endpoint:     e.Endpoint,
+			auth:         e.Auth,
+		}
+	}
+	e.transport = rt
+}
+
+// closeIdle closes the idle connections of an endpoint which is no longer
+// used.
+func (e *ChainEndpoint) closeIdle() {
+	if e.conns != nil {
+		e.conns.CloseIdleConnections()
+	}
+}
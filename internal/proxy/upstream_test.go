@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildTransportRedactsMetricLabels(t *testing.T) {
+	e := &ChainEndpoint{Endpoint: "https://provider.example/v3/s3cret"}
+	e.buildTransport("ethereum")
+	tr, ok := e.transport.(*tracedTransport)
+	if !ok {
+		t.Fatalf("transport is %T, want *tracedTransport", e.transport)
+	}
+	if strings.Contains(tr.endpoint, "s3cret") {
+		t.Errorf("metrics label %s exposes the endpoint url", tr.endpoint)
+	}
+	if tr.endpoint != endpointLabel(e.Endpoint) {
+		t.Errorf("metrics label = %s, want %s", tr.endpoint, endpointLabel(e.Endpoint))
+	}
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// secretFileTTL is how long secrets read from files are cached before
+	// they are read again, so rotated secrets are picked up
+	secretFileTTL = time.Minute
+)
+
+// secretValue is a credential given inline, or read from an env var or a
+// file so it can be kept out of the config file.
+type secretValue struct {
+	Value string `json:"value,omitempty"`
+	Env   string `json:"env,omitempty"`
+	File  string `json:"file,omitempty"`
+
+	mu   sync.Mutex
+	data string
+	read time.Time
+}
+
+// upstreamAuth is the credentials sent with every request to an endpoint.
+type upstreamAuth struct {
+	// Bearer is sent as an Authorization bearer token
+	Bearer *secretValue `json:"bearer,omitempty"`
+	Basic  *basicAuth   `json:"basic,omitempty"`
+	// Headers and Query are added to the request headers and query string
+	Headers map[string]*secretValue `json:"headers,omitempty"`
+	Query   map[string]*secretValue `json:"query,omitempty"`
+}
+
+type basicAuth struct {
+	Username string       `json:"username"`
+	Password *secretValue `json:"password"`
+}
+
+// authTransport adds an endpoint's credentials to requests sent through it.
+type authTransport struct {
+	http.RoundTripper
+	endpoint string
+	auth     *upstreamAuth
+}
+
+// MarshalJSON keeps inline secrets out of logs.
+func (s *secretValue) MarshalJSON() ([]byte, error) {
+	switch {
+	case s.Env != "":
+		return json.Marshal(map[string]string{"env": s.Env})
+	case s.File != "":
+		return json.Marshal(map[string]string{"file": s.File})
+	}
+	return json.Marshal(map[string]string{"value": "redacted"})
+}
+
+// get returns the secret. Files are cached for secretFileTTL.
+func (s *secretValue) get() (string, error) {
+	if s == nil {
+		return "", errors.New("missing secret")
+	}
+	switch {
+	case s.Value != "":
+		return s.Value, nil
+	case s.Env != "":
+		v := os.Getenv(s.Env)
+		if v == "" {
+			return "", errors.New("secret env var " + s.Env + " is not set")
+		}
+		return v, nil
+	case s.File != "":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.data != "" && time.Since(s.read) < secretFileTTL {
+			return s.data, nil
+		}
+		b, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			if s.data != "" {
+				// keep using the last secret read until the file is back
+				log.WithFields(log.Fields{
+					"action": "secretValue.get",
+					"file":   s.File,
+				}).WithError(err).Warn("failed to reread secret file")
+				return s.data, nil
+			}
+			return "", err
+		}
+		s.data = strings.TrimSpace(string(b))
+		s.read = time.Now()
+		if s.data == "" {
+			return "", errors.New("secret file " + s.File + " is empty")
+		}
+		return s.data, nil
+	}
+	return "", errors.New("secret has no value, env or file")
+}
+
+func (s *secretValue) equal(o *secretValue) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	return s.Value == o.Value && s.Env == o.Env && s.File == o.File
+}
+
+func secretsEqual(a, b map[string]*secretValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, s := range a {
+		if !s.equal(b[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// equal reports whether two endpoint auth configs send the same
+// credentials.
+func (a *upstreamAuth) equal(o *upstreamAuth) bool {
+	if a == nil || o == nil {
+		return a == o
+	}
+	if (a.Basic == nil) != (o.Basic == nil) {
+		return false
+	}
+	if a.Basic != nil && (a.Basic.Username != o.Basic.Username || !a.Basic.Password.equal(o.Basic.Password)) {
+		return false
+	}
+	return a.Bearer.equal(o.Bearer) && secretsEqual(a.Headers, o.Headers) && secretsEqual(a.Query, o.Query)
+}
+
+// validate checks that all of the credentials can be resolved.
+func (a *upstreamAuth) validate() error {
+	if a.Bearer != nil {
+		if _, err := a.Bearer.get(); err != nil {
+			return err
+		}
+	}
+	if a.Basic != nil {
+		if _, err := a.Basic.Password.get(); err != nil {
+			return err
+		}
+	}
+	for _, m := range []map[string]*secretValue{a.Headers, a.Query} {
+		for _, s := range m {
+			if _, err := s.get(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// apply sets the credentials on the request.
+func (a *upstreamAuth) apply(req *http.Request) error {
+	if a.Bearer != nil {
+		v, err := a.Bearer.get()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+v)
+	}
+	if a.Basic != nil {
+		v, err := a.Basic.Password.get()
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(a.Basic.Username, v)
+	}
+	for h, s := range a.Headers {
+		v, err := s.get()
+		if err != nil {
+			return err
+		}
+		req.Header.Set(h, v)
+	}
+	if len(a.Query) > 0 {
+		q := req.URL.Query()
+		for k, s := range a.Query {
+			v, err := s.get()
+			if err != nil {
+				return err
+			}
+			q.Set(k, v)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+	return nil
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	if err := t.auth.apply(r); err != nil {
+		log.WithFields(log.Fields{
+			"action":   "authTransport.RoundTrip",
+			"endpoint": endpointHost(t.endpoint),
+		}).WithError(err).Error("failed to resolve upstream credentials")
+		return nil, err
+	}
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if ue, ok := err.(*url.Error); ok {
+		// errors include the url, which may now hold query credentials
+		ue.URL = t.endpoint
+	}
+	return resp, err
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSecretValueMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret *secretValue
+		want   map[string]string
+	}{
+		{
+			name:   "inline value is redacted",
+			secret: &secretValue{Value: "s3cret"},
+			want:   map[string]string{"value": "redacted"},
+		},
+		{
+			name:   "env",
+			secret: &secretValue{Env: "RPC_KEY"},
+			want:   map[string]string{"env": "RPC_KEY"},
+		},
+		{
+			name:   "file",
+			secret: &secretValue{File: "/run/secrets/rpc"},
+			want:   map[string]string{"file": "/run/secrets/rpc"},
+		},
+		{
+			name:   "quotes are escaped",
+			secret: &secretValue{File: `/run/"secrets"\rpc`},
+			want:   map[string]string{"file": `/run/"secrets"\rpc`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("MarshalJSON() = %s, not valid JSON: %v", b, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MarshalJSON() = %s, want %v", b, tt.want)
+			}
+			if strings.Contains(string(b), "s3cret") {
+				t.Errorf("MarshalJSON() = %s exposes the secret", b)
+			}
+		})
+	}
+}
+
+func TestUpstreamAuthApply(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_RPC_KEY", "from-env")
+	a := &upstreamAuth{
+		Bearer:  &secretValue{File: file},
+		Headers: map[string]*secretValue{"X-Api-Key": {Env: "TEST_RPC_KEY"}},
+		Query:   map[string]*secretValue{"apikey": {Value: "inline"}},
+	}
+	if err := a.validate(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "https://provider.example/rpc?x=1", nil)
+	if err := a.apply(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer from-file" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer from-file")
+	}
+	if got := req.Header.Get("X-Api-Key"); got != "from-env" {
+		t.Errorf("X-Api-Key = %q, want %q", got, "from-env")
+	}
+	if got := req.URL.Query(); got.Get("apikey") != "inline" || got.Get("x") != "1" {
+		t.Errorf("query = %s, want apikey=inline&x=1", req.URL.RawQuery)
+	}
+
+	basic := &upstreamAuth{Basic: &basicAuth{Username: "user", Password: &secretValue{Env: "TEST_RPC_MISSING"}}}
+	if err := basic.validate(); err == nil {
+		t.Error("validate() accepted an unset env var")
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/metrics"
+	"github.com/robertlestak/ethlb/internal/ratelimit"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// minAcquireBackoff and maxAcquireBackoff bound the wait between
+	// attempts to acquire endpoints at maxConcurrent
+	minAcquireBackoff = time.Millisecond * 10
+	maxAcquireBackoff = time.Millisecond * 200
+)
+
+var (
+	errEndpointsBusy   = errors.New("all endpoints at capacity")
+	errEndpointsBehind = errors.New("no endpoint has reached the requested block")
+)
+
+// limitKey names the endpoint's rate limit bucket without exposing
+// credentials which may be part of the endpoint URL.
+func (e *ChainEndpoint) limitKey() string {
+	return fmt.Sprintf("endpoint:%x", sha256.Sum256([]byte(e.Endpoint)))[:25]
+}
+
+// endpointLabel identifies an endpoint in metrics by its host and a short
+// hash of its URL, so endpoints on one host stay apart without exposing
+// credentials which may be part of the URL.
+func endpointLabel(endpoint string) string {
+	sum := sha256.Sum256([]byte(endpoint))
+	return fmt.Sprintf("%s/%x", endpointHost(endpoint), sum[:4])
+}
+
+// Inflight returns the number of requests currently sent to the endpoint.
+func (e *ChainEndpoint) Inflight() int32 {
+	if e.inflight == nil {
+		return 0
+	}
+	return atomic.LoadInt32(e.inflight)
+}
+
+// acquire reserves capacity for one upstream attempt to the endpoint within
+// its maxConcurrent and rateLimit settings. Each successful acquire must be
+// followed by a release once the attempt completes. When the rate limit
+// denies the attempt, it returns how long until it would be allowed.
+func (e *ChainEndpoint) acquire(chainName string) (bool, time.Duration) {
+	n := atomic.AddInt32(e.inflight, 1)
+	if e.MaxConcurrent > 0 && int(n) > e.MaxConcurrent {
+		atomic.AddInt32(e.inflight, -1)
+		return false, 0
+	}
+	if e.RateLimit != nil && e.RateLimit.Rate > 0 {
+		if ok, wait := ratelimit.Take(e.limitKey(), e.RateLimit, 1); !ok {
+			atomic.AddInt32(e.inflight, -1)
+			return false, wait
+		}
+	}
+	metrics.EndpointInflight.WithLabelValues(chainName, endpointLabel(e.Endpoint)).Set(float64(n))
+	return true, 0
+}
+
+// acquireEndpoint reserves capacity for an upstream attempt, starting with
+// the preferred endpoint and spilling over to the chain's other endpoints.
+// Endpoints with a head below minHead are skipped. While all are at
+// capacity it waits, until the earliest rate limit allows an attempt or
+// with a backoff while endpoints are at maxConcurrent, for up to
+// ENDPOINT_ACQUIRE_TIMEOUT.
+func acquireEndpoint(ctx context.Context, chainName string, preferred *ChainEndpoint, readOnly bool, minHead uint64) (*ChainEndpoint, error) {
+	l := log.WithFields(log.Fields{
+		"chain":  chainName,
+		"action": "acquireEndpoint",
+	})
+	var c *chain
+	for _, ch := range Chains {
+		if ch.Name == chainName {
+			c = ch
+		}
+	}
+	var endpoints []*ChainEndpoint
+	if preferred.blockHead() >= minHead {
+		endpoints = append(endpoints, preferred)
+	}
+	if c != nil {
+		if cands, err := c.candidates(readOnly); err == nil {
+			for _, e := range cands {
+				if e != preferred && e.blockHead() >= minHead {
+					endpoints = append(endpoints, e)
+				}
+			}
+		}
+	}
+	if len(endpoints) == 0 {
+		l.WithField("minHead", minHead).Warn("no endpoint has reached the block")
+		return nil, errEndpointsBehind
+	}
+	deadline := time.Now().Add(endpointAcquireTimeout)
+	backoff := minAcquireBackoff
+	for {
+		wait := backoff
+		for _, e := range endpoints {
+			ok, w := e.acquire(chainName)
+			if ok {
+				return e, nil
+			}
+			if w > 0 && w < wait {
+				wait = w
+			}
+		}
+		if time.Now().Add(wait).After(deadline) {
+			l.Warn("all endpoints at capacity")
+			return nil, errEndpointsBusy
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > maxAcquireBackoff {
+			backoff = maxAcquireBackoff
+		}
+	}
+}
+
+// release returns the capacity reserved by acquire.
+func (e *ChainEndpoint) release(chainName string) {
+	n := atomic.AddInt32(e.inflight, -1)
+	metrics.EndpointInflight.WithLabelValues(chainName, endpointLabel(e.Endpoint)).Set(float64(n))
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/robertlestak/ethlb/internal/cache"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// warmBlockPlaceholder is replaced in warm call params with the hex
+	// number of the block being warmed
+	warmBlockPlaceholder = `"$block"`
+	// maxWarmBlocks bounds how many blocks are warmed when the head moves
+	// more than one block between probes
+	maxWarmBlocks = 16
+)
+
+// defaultWarmCalls are warmed for each new block when cache warming is
+// enabled without any calls configured.
+var defaultWarmCalls = []*JSONRPCRequest{
+	{Method: "eth_getBlockByNumber", Params: json.RawMessage(`["$block", true]`)},
+	{Method: "eth_getBlockReceipts", Params: json.RawMessage(`["$block"]`)},
+}
+
+// cacheWarmConfig configures the calls proactively cached for each new head
+// of a chain.
+type cacheWarmConfig struct {
+	Enabled bool              `json:"enabled"`
+	Calls   []*JSONRPCRequest `json:"calls,omitempty"`
+}
+
+type warmState struct {
+	running int32
+	head    uint64
+}
+
+// call sends a JSON-RPC request body to the chain through the proxy
+// transport, so the response is cached exactly as a client request would be.
+// It is only sent to endpoints whose head is at least minHead. It prefers
+// the endpoint furthest ahead, leaving the round robin of client requests
+// untouched.
+func (c *chain) call(ctx context.Context, body []byte, d cacheDirectives, minHead uint64) ([]byte, error) {
+	cands, err := c.candidates(true)
+	if err != nil {
+		return nil, err
+	}
+	e := cands[0]
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	t := &transport{
+		chain:      c.Name,
+		endpoint:   e,
+		readOnly:   true,
+		minHead:    minHead,
+		directives: d,
+		internal:   true,
+	}
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %d", resp.StatusCode)
+	}
+	return rb, nil
+}
+
+func (w *cacheWarmConfig) calls() []*JSONRPCRequest {
+	if len(w.Calls) == 0 {
+		return defaultWarmCalls
+	}
+	return w.Calls
+}
+
+// warmBlock fetches the configured calls for block n. Calls are sent one by
+// one so they share cache entries with clients requesting them individually.
+func (c *chain) warmBlock(ctx context.Context, n uint64) error {
+	l := log.WithFields(log.Fields{
+		"chain":  c.Name,
+		"action": "warmBlock",
+		"block":  n,
+	})
+	l.Debug("start")
+	var failed int
+	bn := []byte(fmt.Sprintf(`"0x%x"`, n))
+	for i, wc := range c.CacheWarm.calls() {
+		call := &JSONRPCRequest{
+			Jsonrpc: "2.0",
+			ID:      json.RawMessage(fmt.Sprint(i + 1)),
+			Method:  wc.Method,
+			Params:  json.RawMessage(bytes.ReplaceAll(wc.Params, []byte(warmBlockPlaceholder), bn)),
+		}
+		body, err := json.Marshal(call)
+		if err != nil {
+			return err
+		}
+		if _, err := c.call(ctx, body, cacheDirectives{}, n); err != nil {
+			l.WithError(err).WithField("call", wc.Method).Warn("failed to warm cache")
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.New("failed to warm all calls")
+	}
+	return nil
+}
+
+// warmCache warms the cache for blocks produced since the last warmed head.
+// Only one warm runs per chain at a time, heads seen while it runs are
+// picked up by the next one.
+func (c *chain) warmCache(ctx context.Context) {
+	if c.CacheWarm == nil || !c.CacheWarm.Enabled || os.Getenv("CACHE_DISABLED") == "true" || !cache.Available() {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&c.warm.running, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&c.warm.running, 0)
+	l := log.WithFields(log.Fields{
+		"chain":  c.Name,
+		"action": "warmCache",
+	})
+	head := c.head()
+	last := atomic.LoadUint64(&c.warm.head)
+	if head == 0 || head <= last {
+		return
+	}
+	from := last + 1
+	if last == 0 || head-last > maxWarmBlocks {
+		from = head
+		if last != 0 {
+			from = head - maxWarmBlocks + 1
+		}
+	}
+	l = l.WithFields(log.Fields{
+		"from": from,
+		"to":   head,
+	})
+	l.Debug("warming cache")
+	for n := from; n <= head; n++ {
+		if ctx.Err() != nil {
+			l.Debug("stopped warming cache")
+			return
+		}
+		if err := c.warmBlock(ctx, n); err != nil {
+			l.WithError(err).WithField("block", n).Warn("failed to warm block")
+		}
+	}
+	atomic.StoreUint64(&c.warm.head, head)
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/cache"
+)
+
+// fakeNode is a minimal JSON-RPC node serving a chain of empty blocks up to
+// head. Block hashes can be replaced to simulate reorgs, and a failing node
+// answers every request with HTTP 503.
+type fakeNode struct {
+	*httptest.Server
+	mu      sync.Mutex
+	head    uint64
+	hashes  map[uint64]string
+	calls   map[string]int
+	failing bool
+}
+
+func newFakeNode(t *testing.T, head uint64) *fakeNode {
+	t.Helper()
+	n := &fakeNode{
+		head:   head,
+		hashes: make(map[uint64]string),
+		calls:  make(map[string]int),
+	}
+	n.Server = httptest.NewServer(http.HandlerFunc(n.serve))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *fakeNode) setHead(head uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.head = head
+}
+
+func (n *fakeNode) setFailing(failing bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.failing = failing
+}
+
+// reorg replaces the hashes of blocks from and above.
+func (n *fakeNode) reorg(from uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for b := from; b <= n.head; b++ {
+		n.hashes[b] = fmt.Sprintf("0x%064x", b+1<<32)
+	}
+}
+
+func (n *fakeNode) callCount(method string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls[method]
+}
+
+func (n *fakeNode) hash(b uint64) string {
+	if h, ok := n.hashes[b]; ok {
+		return h
+	}
+	return fmt.Sprintf("0x%064x", b)
+}
+
+func (n *fakeNode) serve(w http.ResponseWriter, r *http.Request) {
+	req := &JSONRPCRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls[req.Method]++
+	if n.failing {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var result interface{}
+	switch req.Method {
+	case "eth_blockNumber":
+		result = fmt.Sprintf("0x%x", n.head)
+	case "eth_getBlockByNumber", "eth_getBlockReceipts":
+		p := req.params()
+		var ref string
+		if len(p) > 0 {
+			json.Unmarshal(p[0], &ref)
+		}
+		b, ok := parseHexUint(ref)
+		if !ok {
+			b = n.head
+		}
+		if b > n.head {
+			break
+		}
+		if req.Method == "eth_getBlockReceipts" {
+			result = []interface{}{}
+			break
+		}
+		parent := n.hash(0)
+		if b > 0 {
+			parent = n.hash(b - 1)
+		}
+		result = map[string]interface{}{
+			"number":       fmt.Sprintf("0x%x", b),
+			"hash":         n.hash(b),
+			"parentHash":   parent,
+			"transactions": []interface{}{},
+		}
+	default:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      req.ID,
+			"error":   map[string]interface{}{"code": -32601, "message": "method not found"},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      req.ID,
+		"result":  result,
+	})
+}
+
+// useTestChains loads config as the current chains, backed by an empty
+// in-memory cache, until the test ends.
+func useTestChains(t *testing.T, config string) {
+	t.Helper()
+	t.Setenv("CACHE_BACKEND", "memory")
+	if err := cache.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	prev := Chains
+	t.Cleanup(func() {
+		workers.Wait()
+		Chains = prev
+	})
+	if err := UnmarshalJSON([]byte(config)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func blockCacheKey(t *testing.T, chainName string, method string, params string) string {
+	t.Helper()
+	r := mustParseRPCRequest(t, `{"jsonrpc":"2.0","id":1,"method":"`+method+`","params":`+params+`}`)
+	key, err := r.cacheKey(chainName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestWarmedBlocksOutliveTheNextProbe(t *testing.T) {
+	defer func(ttl time.Duration) { cacheUnpinnedTTL = ttl }(cacheUnpinnedTTL)
+	// anything cached with the unpinned ttl is gone by the next probe
+	cacheUnpinnedTTL = time.Millisecond
+	node := newFakeNode(t, 100)
+	useTestChains(t, `[{"name":"warm","cacheWarm":{"enabled":true},"endpoints":[{"endpoint":"`+node.URL+`","enabled":true}]}]`)
+	c := Chains[0]
+	ctx := context.Background()
+	if err := c.UpdateEndpointBlockHead(ctx); err != nil {
+		t.Fatal(err)
+	}
+	workers.Wait()
+	node.setHead(101)
+	time.Sleep(10 * time.Millisecond)
+	if err := c.UpdateEndpointBlockHead(ctx); err != nil {
+		t.Fatal(err)
+	}
+	workers.Wait()
+	for _, b := range []uint64{100, 101} {
+		hex := strconv.Quote(fmt.Sprintf("0x%x", b))
+		for _, k := range []string{
+			blockCacheKey(t, c.Name, "eth_getBlockByNumber", "["+hex+",true]"),
+			blockCacheKey(t, c.Name, "eth_getBlockReceipts", "["+hex+"]"),
+		} {
+			if v, err := cache.Get(k); err != nil || v == "" {
+				t.Errorf("block %d: %s not cached", b, k)
+			}
+		}
+	}
+	if n := node.callCount("eth_getBlockReceipts"); n != 2 {
+		t.Errorf("eth_getBlockReceipts called %d times, want 2", n)
+	}
+	if c.next != 0 {
+		t.Errorf("warming moved the client round robin to %d", c.next)
+	}
+}
@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+// localLimiter keeps token buckets in memory, limiting each replica on its
+// own.
+type localLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newLocalLimiter() *localLimiter {
+	return &localLimiter{
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *localLimiter) take(key string, r *Rate, n float64) (bool, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	burst := r.burst()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*r.Rate)
+	b.last = now
+	// requests costing more than the bucket holds need a full bucket
+	n = math.Min(n, burst)
+	if b.tokens < n {
+		wait := time.Duration((n - b.tokens) / r.Rate * float64(time.Second))
+		return false, wait, nil
+	}
+	b.tokens -= n
+	b.full = now.Add(time.Duration((burst - b.tokens) / r.Rate * float64(time.Second)))
+	return true, 0, nil
+}
+
+func (l *localLimiter) refund(key string, r *Rate, n float64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		return nil
+	}
+	burst := r.burst()
+	b.tokens = math.Min(burst, b.tokens+math.Min(n, burst))
+	return nil
+}
+
+// sweep drops buckets which have refilled, as they are the same as new ones,
+// until ctx is done.
+func (l *localLimiter) sweep(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+		now := time.Now()
+		l.mu.Lock()
+		for k, b := range l.buckets {
+			if now.After(b.full) {
+				delete(l.buckets, k)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,154 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalLimiterTake(t *testing.T) {
+	// step takes n units after advancing the bucket's clock by elapsed, or
+	// refunds n units
+	type step struct {
+		elapsed time.Duration
+		refund  bool
+		n       float64
+		allowed bool
+		wait    time.Duration
+	}
+	tests := []struct {
+		name  string
+		rate  *Rate
+		steps []step
+	}{
+		{
+			name: "burst then deny",
+			rate: &Rate{Rate: 1, Burst: 2},
+			steps: []step{
+				{n: 1, allowed: true},
+				{n: 1, allowed: true},
+				{n: 1, wait: time.Second},
+			},
+		},
+		{
+			name: "burst defaults to one second of rate",
+			rate: &Rate{Rate: 3},
+			steps: []step{
+				{n: 3, allowed: true},
+				{n: 1, wait: time.Second / 3},
+			},
+		},
+		{
+			name: "burst is at least one unit",
+			rate: &Rate{Rate: 0.5},
+			steps: []step{
+				{n: 1, allowed: true},
+				{n: 1, wait: 2 * time.Second},
+			},
+		},
+		{
+			name: "refills over time",
+			rate: &Rate{Rate: 2, Burst: 2},
+			steps: []step{
+				{n: 2, allowed: true},
+				{n: 1, wait: time.Second / 2},
+				{elapsed: time.Second / 2, n: 1, allowed: true},
+				{n: 1, wait: time.Second / 2},
+			},
+		},
+		{
+			name: "refill is capped at burst",
+			rate: &Rate{Rate: 10, Burst: 2},
+			steps: []step{
+				{n: 2, allowed: true},
+				{elapsed: time.Hour, n: 2, allowed: true},
+				{n: 1, wait: time.Second / 10},
+			},
+		},
+		{
+			name: "cost larger than burst needs a full bucket",
+			rate: &Rate{Rate: 1, Burst: 2},
+			steps: []step{
+				{n: 5, allowed: true},
+				{n: 5, wait: 2 * time.Second},
+				{elapsed: time.Second, n: 5, wait: time.Second},
+				{elapsed: time.Second, n: 5, allowed: true},
+			},
+		},
+		{
+			name: "denied takes nothing",
+			rate: &Rate{Rate: 1, Burst: 3},
+			steps: []step{
+				{n: 2, allowed: true},
+				{n: 2, wait: time.Second},
+				{n: 1, allowed: true},
+			},
+		},
+		{
+			name: "refund returns units",
+			rate: &Rate{Rate: 1, Burst: 2},
+			steps: []step{
+				{n: 2, allowed: true},
+				{refund: true, n: 1},
+				{n: 1, allowed: true},
+				{n: 1, wait: time.Second},
+			},
+		},
+		{
+			name: "refund is capped at burst",
+			rate: &Rate{Rate: 1, Burst: 2},
+			steps: []step{
+				{n: 1, allowed: true},
+				{refund: true, n: 10},
+				{n: 2, allowed: true},
+				{n: 1, wait: time.Second},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLocalLimiter()
+			for i, s := range tt.steps {
+				if b, ok := l.buckets["k"]; ok {
+					b.last = b.last.Add(-s.elapsed)
+				}
+				if s.refund {
+					if err := l.refund("k", tt.rate, s.n); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				allowed, wait, err := l.take("k", tt.rate, s.n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if allowed != s.allowed {
+					t.Fatalf("step %d: take() allowed = %v, want %v", i, allowed, s.allowed)
+				}
+				// time passes between steps, so waits are only close
+				if d := s.wait - wait; d < 0 || d > 10*time.Millisecond {
+					t.Errorf("step %d: take() wait = %v, want %v", i, wait, s.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestLocalLimiterKeys(t *testing.T) {
+	l := newLocalLimiter()
+	r := &Rate{Rate: 1, Burst: 1}
+	if ok, _, _ := l.take("a", r, 1); !ok {
+		t.Fatal("a denied")
+	}
+	if ok, _, _ := l.take("a", r, 1); ok {
+		t.Error("a allowed past its burst")
+	}
+	if ok, _, _ := l.take("b", r, 1); !ok {
+		t.Error("b denied by a's bucket")
+	}
+	if err := l.refund("c", r, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.buckets["c"]; ok {
+		t.Error("refund created a bucket")
+	}
+}
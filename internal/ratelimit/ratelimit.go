@@ -0,0 +1,226 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/ethlb/internal/cache"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rate is a token bucket refilled with Rate cost units per second, holding
+// at most Burst units.
+type Rate struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst,omitempty"`
+}
+
+type cost struct {
+	pattern string
+	units   float64
+}
+
+// limiter takes n units from the named bucket, returning whether they were
+// available and, if not, how long until they will be. refund returns units
+// taken for a request which was denied by another limit.
+type limiter interface {
+	take(key string, r *Rate, n float64) (bool, time.Duration, error)
+	refund(key string, r *Rate, n float64) error
+}
+
+var (
+	// ClientRate limits each API key, or client IP without keys. Nil
+	// disables client limits.
+	ClientRate *Rate
+	// ChainRate limits all clients of a chain together. Nil disables chain
+	// limits.
+	ChainRate *Rate
+
+	costs []*cost
+	// trustForwarded identifies clients by X-Forwarded-For
+	trustForwarded bool
+
+	backend limiter
+	local   = newLocalLimiter()
+)
+
+// burst returns the bucket size, defaulting to one second of rate.
+func (r *Rate) burst() float64 {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	if r.Rate < 1 {
+		return 1
+	}
+	return r.Rate
+}
+
+func parseRate(rate, burst string) (*Rate, error) {
+	if rate == "" {
+		return nil, nil
+	}
+	r := &Rate{}
+	var err error
+	if r.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+		return nil, err
+	}
+	if r.Rate <= 0 {
+		return nil, errors.New("rate must be positive")
+	}
+	if burst != "" {
+		if r.Burst, err = strconv.ParseFloat(burst, 64); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// parseCosts parses comma separated method:units pairs. Methods may use
+// wildcards, e.g. "eth_getLogs:10,trace_*:20".
+func parseCosts(s string) ([]*cost, error) {
+	var cs []*cost
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		i := strings.LastIndex(p, ":")
+		if i <= 0 {
+			return nil, errors.New("invalid method cost " + p)
+		}
+		u, err := strconv.ParseFloat(p[i+1:], 64)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, &cost{pattern: p[:i], units: u})
+	}
+	return cs, nil
+}
+
+// Init configures rate limits from the RATE_LIMIT_* env vars. Limits are
+// disabled unless a rate is set. Idle local buckets are swept until ctx is
+// done.
+func Init(ctx context.Context) error {
+	l := log.WithFields(log.Fields{
+		"package": "ratelimit",
+	})
+	l.Debug("Initializing rate limits")
+	var err error
+	if ClientRate, err = parseRate(os.Getenv("RATE_LIMIT_RATE"), os.Getenv("RATE_LIMIT_BURST")); err != nil {
+		l.WithError(err).Error("Failed to parse RATE_LIMIT_RATE")
+		return err
+	}
+	if ChainRate, err = parseRate(os.Getenv("RATE_LIMIT_CHAIN_RATE"), os.Getenv("RATE_LIMIT_CHAIN_BURST")); err != nil {
+		l.WithError(err).Error("Failed to parse RATE_LIMIT_CHAIN_RATE")
+		return err
+	}
+	if costs, err = parseCosts(os.Getenv("RATE_LIMIT_COSTS")); err != nil {
+		l.WithError(err).Error("Failed to parse RATE_LIMIT_COSTS")
+		return err
+	}
+	trustForwarded = os.Getenv("RATE_LIMIT_TRUST_FORWARDED") == "true"
+	switch os.Getenv("RATE_LIMIT_BACKEND") {
+	case "", "local":
+		backend = local
+	case "redis":
+		if cache.Client == nil {
+			l.Error("Redis rate limits require a redis cache backend")
+			return cache.ErrNoRedis
+		}
+		backend = &redisLimiter{}
+	default:
+		return errors.New("unknown rate limit backend " + os.Getenv("RATE_LIMIT_BACKEND"))
+	}
+	go local.sweep(ctx)
+	return nil
+}
+
+// Cost returns the cost units of a JSON-RPC method. The first matching
+// configured cost applies, and methods without one cost 1.
+func Cost(method string) float64 {
+	for _, c := range costs {
+		if ok, _ := path.Match(c.pattern, method); ok {
+			return c.units
+		}
+	}
+	return 1
+}
+
+// ClientIP returns the address a request came from, trusting
+// X-Forwarded-For only when RATE_LIMIT_TRUST_FORWARDED is set.
+func ClientIP(remoteAddr string, forwardedFor string) string {
+	if trustForwarded && forwardedFor != "" {
+		return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+	}
+	if i := strings.LastIndex(remoteAddr, ":"); i > 0 {
+		return strings.Trim(remoteAddr[:i], "[]")
+	}
+	return remoteAddr
+}
+
+func take(key string, r *Rate, n float64) (bool, time.Duration) {
+	ok, wait, err := backend.take(key, r, n)
+	if err != nil {
+		// keep limiting per replica while redis is unavailable
+		log.WithFields(log.Fields{
+			"package": "ratelimit",
+		}).WithError(err).Debug("Failed to take from shared bucket, using local bucket")
+		ok, wait, _ = local.take(key, r, n)
+	}
+	return ok, wait
+}
+
+func refund(key string, r *Rate, n float64) {
+	if err := backend.refund(key, r, n); err != nil {
+		log.WithFields(log.Fields{
+			"package": "ratelimit",
+		}).WithError(err).Debug("Failed to refund shared bucket, refunding local bucket")
+		local.refund(key, r, n)
+	}
+}
+
+// Allow takes n cost units from the client's and the chain's buckets. The
+// client rate overrides ClientRate when set. Units taken from the client's
+// bucket are refunded when the chain's limit denies the request. When
+// denied, it returns how long until the request would be allowed.
+func Allow(client string, clientRate *Rate, chain string, chainRate *Rate, n float64) (bool, time.Duration) {
+	if backend == nil {
+		return true, 0
+	}
+	if clientRate == nil {
+		clientRate = ClientRate
+	}
+	if chainRate == nil {
+		chainRate = ChainRate
+	}
+	limitClient := clientRate != nil && clientRate.Rate > 0
+	if limitClient {
+		if ok, wait := take("client:"+client, clientRate, n); !ok {
+			return false, wait
+		}
+	}
+	if chainRate != nil && chainRate.Rate > 0 {
+		if ok, wait := take("chain:"+chain, chainRate, n); !ok {
+			if limitClient {
+				refund("client:"+client, clientRate, n)
+			}
+			return false, wait
+		}
+	}
+	return true, 0
+}
+
+// Take takes n cost units from the named bucket, for limits other than the
+// client and chain limits such as upstream quotas.
+func Take(key string, r *Rate, n float64) (bool, time.Duration) {
+	if backend == nil {
+		ok, wait, _ := local.take(key, r, n)
+		return ok, wait
+	}
+	return take(key, r, n)
+}
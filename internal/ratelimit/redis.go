@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/robertlestak/ethlb/internal/cache"
+)
+
+const (
+	redisKeyPrefix = "ratelimit:"
+)
+
+// takeScript refills and takes from a token bucket stored as a hash of
+// tokens and last refill time in milliseconds. It returns whether the
+// tokens were taken and otherwise the milliseconds until they will be.
+// The time is passed in so the script stays deterministic for replication.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local b = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(b[1])
+local ts = tonumber(b[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+	ts = now
+end
+local allowed = 0
+local wait = 0
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+else
+	wait = math.ceil((n - tokens) / rate * 1000)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", ts)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// refundScript returns tokens to a bucket, up to its burst. Missing buckets
+// are already full.
+var refundScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+if tokens == nil then
+	return 0
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(math.min(burst, tokens + n)))
+return 1
+`)
+
+// redisLimiter keeps token buckets in redis, shared by all replicas.
+type redisLimiter struct{}
+
+func (l *redisLimiter) take(key string, r *Rate, n float64) (bool, time.Duration, error) {
+	n = math.Min(n, r.burst())
+	v, err := cache.RunScript(takeScript, []string{redisKeyPrefix + key},
+		strconv.FormatFloat(r.Rate, 'f', -1, 64),
+		strconv.FormatFloat(r.burst(), 'f', -1, 64),
+		strconv.FormatFloat(n, 'f', -1, 64),
+		time.Now().UnixNano()/int64(time.Millisecond),
+	)
+	if err != nil {
+		return false, 0, err
+	}
+	res, ok := v.([]interface{})
+	if !ok || len(res) != 2 {
+		return false, 0, errors.New("unexpected rate limit script result")
+	}
+	allowed, _ := res[0].(int64)
+	wait, _ := res[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+func (l *redisLimiter) refund(key string, r *Rate, n float64) error {
+	_, err := cache.RunScript(refundScript, []string{redisKeyPrefix + key},
+		strconv.FormatFloat(r.burst(), 'f', -1, 64),
+		strconv.FormatFloat(math.Min(n, r.burst()), 'f', -1, 64),
+	)
+	return err
+}
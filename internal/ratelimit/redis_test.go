@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/robertlestak/ethlb/internal/cache"
+)
+
+// useMiniredis points the cache at an in-process redis until the test ends.
+func useMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	t.Setenv("CACHE_BACKEND", "redis")
+	t.Setenv("REDIS_HOST", mr.Host())
+	t.Setenv("REDIS_PORT", mr.Port())
+	if err := cache.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	return mr
+}
+
+func TestRedisLimiterTake(t *testing.T) {
+	mr := useMiniredis(t)
+	l := &redisLimiter{}
+	// age moves the bucket's last refill back by d
+	age := func(key string, d time.Duration) {
+		ts, err := strconv.ParseInt(mr.HGet(redisKeyPrefix+key, "ts"), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr.HSet(redisKeyPrefix+key, "ts", strconv.FormatInt(ts-d.Milliseconds(), 10))
+	}
+	r := &Rate{Rate: 2, Burst: 2}
+	steps := []struct {
+		elapsed time.Duration
+		n       float64
+		allowed bool
+		wait    time.Duration
+	}{
+		{n: 2, allowed: true},
+		{n: 1, wait: time.Second / 2},
+		{elapsed: time.Second / 2, n: 1, allowed: true},
+		{n: 1, wait: time.Second / 2},
+		{elapsed: time.Hour, n: 2, allowed: true},
+		// costs larger than the burst need a full bucket
+		{elapsed: time.Second, n: 5, allowed: true},
+		{n: 5, wait: time.Second},
+	}
+	for i, s := range steps {
+		if s.elapsed > 0 {
+			age("k", s.elapsed)
+		}
+		allowed, wait, err := l.take("k", r, s.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != s.allowed {
+			t.Fatalf("step %d: take() allowed = %v, want %v", i, allowed, s.allowed)
+		}
+		// time passes between steps, so waits are only close
+		if d := s.wait - wait; d < 0 || d > 10*time.Millisecond {
+			t.Errorf("step %d: take() wait = %v, want %v", i, wait, s.wait)
+		}
+	}
+	if ttl := mr.TTL(redisKeyPrefix + "k"); ttl <= 0 || ttl > 2*time.Second {
+		t.Errorf("bucket ttl = %v, want until it refills", ttl)
+	}
+}
+
+func TestRedisLimiterRefund(t *testing.T) {
+	mr := useMiniredis(t)
+	l := &redisLimiter{}
+	r := &Rate{Rate: 1, Burst: 2}
+	if err := l.refund("missing", r, 1); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(redisKeyPrefix + "missing") {
+		t.Error("refund created a bucket")
+	}
+	for _, n := range []float64{2, 1} {
+		if _, _, err := l.take("k", r, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.refund("k", r, 10); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, _ := l.take("k", r, 2); !ok {
+		t.Error("refunded tokens were not returned")
+	}
+	if ok, _, _ := l.take("k", r, 1); ok {
+		t.Error("refund was not capped at the burst")
+	}
+}
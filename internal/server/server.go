@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var (
+	// readTimeout and writeTimeout bound the whole request and response,
+	// including upstream retries and long eth_getLogs or trace calls, so
+	// they are disabled by default. Slow clients are still cut off by
+	// readHeaderTimeout.
+	readTimeout       time.Duration
+	readHeaderTimeout = 10 * time.Second
+	writeTimeout      time.Duration
+	idleTimeout       = 120 * time.Second
+	maxHeaderBytes    = http.DefaultMaxHeaderBytes
+	// http2 enables h2 over TLS, h2c enables cleartext HTTP/2
+	http2Enabled = true
+	h2cEnabled   bool
+
+	// shutdownDelay keeps serving after shutdown starts so load balancers
+	// see the replica is not ready before it stops accepting connections,
+	// shutdownTimeout bounds draining in-flight requests
+	shutdownDelay   time.Duration
+	shutdownTimeout = 30 * time.Second
+
+	certFile string
+	keyFile  string
+	certs    *certReloader
+
+	srvMu sync.Mutex
+	srv   *http.Server
+	// active counts running handlers, including upgraded connections which
+	// the server does not track once hijacked
+	active sync.WaitGroup
+	// cancelBase cancels the contexts of all requests, closing upgraded
+	// connections still open when draining times out
+	cancelBase context.CancelFunc
+)
+
+// certReloader serves the most recently loaded certificate, so rotated
+// certificates are used for new connections without a restart.
+type certReloader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	mod  time.Time
+}
+
+func (c *certReloader) load() error {
+	l := log.WithFields(log.Fields{
+		"package":  "server",
+		"certFile": certFile,
+	})
+	fi, err := os.Stat(certFile)
+	if err != nil {
+		l.WithError(err).Error("Failed to stat certificate")
+		return err
+	}
+	ki, err := os.Stat(keyFile)
+	if err != nil {
+		l.WithError(err).Error("Failed to stat key")
+		return err
+	}
+	mod := fi.ModTime()
+	if ki.ModTime().After(mod) {
+		mod = ki.ModTime()
+	}
+	c.mu.RLock()
+	unchanged := c.cert != nil && mod.Equal(c.mod)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		l.WithError(err).Error("Failed to load certificate")
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mod = mod
+	c.mu.Unlock()
+	l.Debug("Loaded certificate")
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func parseDuration(name string, d *time.Duration) error {
+	if os.Getenv(name) == "" {
+		return nil
+	}
+	v, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+func parseBool(name string, b *bool) error {
+	if os.Getenv(name) == "" {
+		return nil
+	}
+	v, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// Init configures the listener from the SERVER_* and TLS_* env vars. TLS is
+// enabled when TLS_CERT_FILE and TLS_KEY_FILE are set, and the certificate
+// is reloaded every minute when its files change. A failed reload keeps the
+// previously loaded certificate.
+func Init() error {
+	l := log.WithFields(log.Fields{
+		"package": "server",
+	})
+	l.Debug("Initializing server")
+	durations := map[string]*time.Duration{
+		"SERVER_READ_TIMEOUT":        &readTimeout,
+		"SERVER_READ_HEADER_TIMEOUT": &readHeaderTimeout,
+		"SERVER_WRITE_TIMEOUT":       &writeTimeout,
+		"SERVER_IDLE_TIMEOUT":        &idleTimeout,
+		"SHUTDOWN_DELAY":             &shutdownDelay,
+		"SHUTDOWN_TIMEOUT":           &shutdownTimeout,
+	}
+	for k, d := range durations {
+		if err := parseDuration(k, d); err != nil {
+			l.WithError(err).Errorf("Failed to parse %s", k)
+			return err
+		}
+	}
+	if os.Getenv("SERVER_MAX_HEADER_BYTES") != "" {
+		v, err := strconv.Atoi(os.Getenv("SERVER_MAX_HEADER_BYTES"))
+		if err != nil {
+			l.WithError(err).Error("Failed to parse SERVER_MAX_HEADER_BYTES")
+			return err
+		}
+		maxHeaderBytes = v
+	}
+	if err := parseBool("SERVER_HTTP2", &http2Enabled); err != nil {
+		l.WithError(err).Error("Failed to parse SERVER_HTTP2")
+		return err
+	}
+	if err := parseBool("SERVER_H2C", &h2cEnabled); err != nil {
+		l.WithError(err).Error("Failed to parse SERVER_H2C")
+		return err
+	}
+	certFile = os.Getenv("TLS_CERT_FILE")
+	keyFile = os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		l.Debug("No certificate, serving plaintext")
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		l.Error("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	certs = &certReloader{}
+	if err := certs.load(); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			time.Sleep(time.Second * 60)
+			if err := certs.load(); err != nil {
+				l.WithError(err).Error("Failed to reload certificate")
+			}
+		}
+	}()
+	return nil
+}
+
+// New returns a server for the handler with the configured timeouts and
+// protocols.
+func New(addr string, h http.Handler) *http.Server {
+	next := h
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active.Add(1)
+		defer active.Done()
+		next.ServeHTTP(w, r)
+	})
+	if h2cEnabled && certs == nil {
+		h = h2c.NewHandler(h, &http2.Server{IdleTimeout: idleTimeout})
+	}
+	base, cancel := context.WithCancel(context.Background())
+	cancelBase = cancel
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		BaseContext: func(net.Listener) context.Context {
+			return base
+		},
+	}
+	if certs != nil {
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.getCertificate,
+		}
+	}
+	if !http2Enabled {
+		// a non-nil map disables the automatic HTTP/2 upgrade
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return srv
+}
+
+// ListenAndServe serves the handler on addr, with TLS if configured. It
+// returns http.ErrServerClosed after Shutdown.
+func ListenAndServe(addr string, h http.Handler) error {
+	s := New(addr, h)
+	srvMu.Lock()
+	srv = s
+	srvMu.Unlock()
+	l := log.WithFields(log.Fields{
+		"package": "server",
+		"addr":    addr,
+		"tls":     certs != nil,
+	})
+	l.Info("Starting server")
+	if certs != nil {
+		return s.ListenAndServeTLS("", "")
+	}
+	return s.ListenAndServe()
+}
+
+// Shutdown waits SHUTDOWN_DELAY, then stops accepting connections and waits
+// up to SHUTDOWN_TIMEOUT for in-flight requests and upgraded connections to
+// finish before closing them.
+func Shutdown() error {
+	l := log.WithFields(log.Fields{
+		"package": "server",
+	})
+	srvMu.Lock()
+	s := srv
+	srvMu.Unlock()
+	if s == nil {
+		return nil
+	}
+	if shutdownDelay > 0 {
+		l.WithField("delay", shutdownDelay).Info("Delaying shutdown")
+		time.Sleep(shutdownDelay)
+	}
+	l.WithField("timeout", shutdownTimeout).Info("Draining connections")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	defer cancelBase()
+	err := s.Shutdown(ctx)
+	if err != nil {
+		l.WithError(err).Warn("Failed to drain all requests")
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		l.Warn("Closing upgraded connections still open")
+		return ctx.Err()
+	}
+	l.Info("Drained connections")
+	return nil
+}
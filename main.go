@@ -1,16 +1,30 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/gorilla/mux"
+	"github.com/robertlestak/ethlb/internal/auth"
 	"github.com/robertlestak/ethlb/internal/cache"
+	"github.com/robertlestak/ethlb/internal/health"
 	"github.com/robertlestak/ethlb/internal/metrics"
 	"github.com/robertlestak/ethlb/internal/proxy"
+	"github.com/robertlestak/ethlb/internal/ratelimit"
+	"github.com/robertlestak/ethlb/internal/server"
 	log "github.com/sirupsen/logrus"
 )
 
+var (
+	// ctx is cancelled on shutdown to stop background workers
+	ctx, stop = context.WithCancel(context.Background())
+	workers   sync.WaitGroup
+)
+
 func init() {
 	ll := log.InfoLevel
 	if os.Getenv("LOG_LEVEL") != "" {
@@ -21,17 +35,57 @@ func init() {
 		}
 	}
 	log.SetLevel(ll)
-	lerr := proxy.HotLoadConfigFile(os.Getenv("CONFIG_FILE"))
+	if uerr := proxy.ConfigUpstreamTransport(); uerr != nil {
+		log.WithError(uerr).Fatal("failed to configure upstream transport")
+	}
+	lerr := proxy.HotLoadConfigFile(ctx, os.Getenv("CONFIG_FILE"))
 	if lerr != nil {
 		log.WithError(lerr).Fatal("failed to load config file")
 	}
+	if rerr := proxy.ConfigReadiness(); rerr != nil {
+		log.WithError(rerr).Fatal("failed to configure readiness")
+	}
 	if cerr := proxy.ConfigRetryHandler(); cerr != nil {
 		log.WithError(cerr).Fatal("failed to configure retry handler")
 	}
-	if ierr := cache.Init(); ierr != nil {
+	if lerr := proxy.ConfigRequestLimits(); lerr != nil {
+		log.WithError(lerr).Fatal("failed to configure request limits")
+	}
+	if serr := proxy.ConfigLogsSplitting(); serr != nil {
+		log.WithError(serr).Fatal("failed to configure logs splitting")
+	}
+	if nerr := proxy.ConfigNegativeCache(); nerr != nil {
+		log.WithError(nerr).Fatal("failed to configure negative cache")
+	}
+	if rerr := proxy.ConfigReorgTracking(); rerr != nil {
+		log.WithError(rerr).Fatal("failed to configure reorg tracking")
+	}
+	if aerr := auth.Init(ctx); aerr != nil {
+		log.WithError(aerr).Fatal("failed to load api keys")
+	}
+	if ierr := cache.Init(ctx); ierr != nil {
 		log.WithError(ierr).Fatal("failed to init cache")
 	}
-	go proxy.HealthProber()
+	if rerr := ratelimit.Init(ctx); rerr != nil {
+		log.WithError(rerr).Fatal("failed to configure rate limits")
+	}
+	if serr := server.Init(); serr != nil {
+		log.WithError(serr).Fatal("failed to configure server")
+	}
+	if serr := proxy.StartHealthSync(); serr != nil {
+		log.WithError(serr).Fatal("failed to start health sync")
+	}
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		proxy.HealthProber(ctx)
+	}()
+	// admin and health endpoints are served on the metrics port
+	http.HandleFunc("/admin/cache", proxy.CacheAdminHandler)
+	http.HandleFunc("/admin/cache/stats", proxy.CacheStatsHandler)
+	http.HandleFunc("/healthz", proxy.HealthReportHandler)
+	http.HandleFunc("/status", proxy.StatusHandler)
+	http.HandleFunc("/status/ui", proxy.StatusPageHandler)
 	go metrics.StartExporter()
 }
 
@@ -43,11 +97,45 @@ func main() {
 	r := mux.NewRouter()
 	r.HandleFunc("/{chain}", proxy.Handler)
 	r.HandleFunc("/{chain}/read", proxy.Handler)
+	r.HandleFunc("/{chain}/{key}", proxy.Handler)
+	r.HandleFunc("/{chain}/{key}/read", proxy.Handler)
 	r.Use(metrics.MeasureResponseDuration)
 	port := "8080"
 	if os.Getenv("PORT") != "" {
 		port = os.Getenv("PORT")
 	}
 	l.Debug("listening on port " + port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	go func() {
+		if err := server.ListenAndServe(":"+port, r); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	sig := <-sigs
+	l.WithField("signal", sig.String()).Info("shutting down")
+	go func() {
+		<-sigs
+		l.Fatal("forced shutdown")
+	}()
+	shutdown()
+	l.Info("shut down")
+}
+
+// shutdown takes the replica out of rotation, drains the server, stops the
+// background workers and closes upstream and redis connections.
+func shutdown() {
+	l := log.WithFields(log.Fields{
+		"action": "shutdown",
+	})
+	health.SetShuttingDown()
+	if err := server.Shutdown(); err != nil {
+		l.WithError(err).Warn("failed to drain server")
+	}
+	stop()
+	workers.Wait()
+	proxy.Close()
+	if err := cache.Close(); err != nil {
+		l.WithError(err).Warn("failed to close cache")
+	}
 }